@@ -0,0 +1,295 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrCircuitOpen 表示熔断器处于打开状态, 请求没有发送到数据库.
+	ErrCircuitOpen = errors.New("db: circuit breaker is open")
+
+	// ErrConcurrencyLimit 表示并发的数据库操作达到了上限, 见 SetConcurrencyLimit.
+	ErrConcurrencyLimit = errors.New("db: too many concurrent requests")
+)
+
+// BreakerState 是熔断器的状态.
+type BreakerState int
+
+const (
+	BreakerClosed   BreakerState = iota // 正常放行所有请求
+	BreakerOpen                         // 拒绝所有请求, 返回 ErrCircuitOpen
+	BreakerHalfOpen                     // 放行少量试探请求, 全部成功后关闭, 任何一个失败重新打开
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// BreakerOptions 设置熔断器打开和恢复的条件, 零值字段使用默认值.
+type BreakerOptions struct {
+	// Window 统计失败率的时间窗口, 默认 10 秒.
+	Window time.Duration
+
+	// MinRequests 窗口内的请求数少于这个值时不会打开, 默认 20.
+	MinRequests int
+
+	// FailureRate 窗口内失败的比例达到这个值时打开, 默认 0.5.
+	FailureRate float64
+
+	// OpenTimeout 打开之后经过这个时间进入半开状态, 默认 5 秒.
+	OpenTimeout time.Duration
+
+	// HalfOpenRequests 半开状态放行的试探请求数, 默认 1.
+	HalfOpenRequests int
+
+	// IsFailure 判断一个错误是否计为失败, 默认见 IsBreakerFailure.
+	IsFailure func(err error) bool
+}
+
+// Breaker 是数据库访问的熔断器, 使用 NewBreaker 创建, 通过 Handle.SetBreaker 启用.
+type Breaker struct {
+	mutex sync.Mutex
+	opts  BreakerOptions
+
+	state       BreakerState
+	generation  uint64 // 每次状态变化加一, 忽略上一个状态中放行的请求的结果
+	windowStart time.Time
+	requests    int
+	failures    int
+	openedAt    time.Time
+	probes      int // 半开状态已经放行的请求数
+	successes   int // 半开状态成功的请求数
+}
+
+func NewBreaker(opts BreakerOptions) *Breaker {
+	if opts.Window <= 0 {
+		opts.Window = time.Second * 10
+	}
+	if opts.MinRequests <= 0 {
+		opts.MinRequests = 20
+	}
+	if opts.FailureRate <= 0 || opts.FailureRate > 1 {
+		opts.FailureRate = 0.5
+	}
+	if opts.OpenTimeout <= 0 {
+		opts.OpenTimeout = time.Second * 5
+	}
+	if opts.HalfOpenRequests <= 0 {
+		opts.HalfOpenRequests = 1
+	}
+	if opts.IsFailure == nil {
+		opts.IsFailure = IsBreakerFailure
+	}
+	return &Breaker{opts: opts, windowStart: time.Now()}
+}
+
+// IsBreakerFailure 是默认的失败判断: 连接错误, 超时和锁冲突等说明数据库状况不好的错误计为失败,
+// sql.ErrNoRows, 调用者取消, 语法错误和唯一键冲突等数据库正常返回的错误不计为失败.
+func IsBreakerFailure(err error) bool {
+	if err == nil || errors.Is(err, sql.ErrNoRows) || errors.Is(err, context.Canceled) {
+		return false
+	}
+	if _, ok := mysqlErrorNumber(err); ok {
+		return IsRetryable(err)
+	}
+	if _, ok := postgresErrorCode(err); ok {
+		return IsRetryable(err)
+	}
+	return true
+}
+
+// State 返回熔断器当前的状态.
+func (b *Breaker) State() BreakerState {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.advance(time.Now())
+	return b.state
+}
+
+// allow 判断是否放行一个请求, 放行时返回当前的 generation, 请求结束后用它调用 done.
+func (b *Breaker) allow() (uint64, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.advance(time.Now())
+	switch b.state {
+	case BreakerOpen:
+		return 0, ErrCircuitOpen
+	case BreakerHalfOpen:
+		if b.probes >= b.opts.HalfOpenRequests {
+			return 0, ErrCircuitOpen
+		}
+		b.probes++
+	}
+	return b.generation, nil
+}
+
+// done 记录 allow 放行的请求的结果.
+func (b *Breaker) done(generation uint64, err error) {
+	failed := b.opts.IsFailure(err)
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	now := time.Now()
+	b.advance(now)
+	if generation != b.generation {
+		return
+	}
+
+	switch b.state {
+	case BreakerClosed:
+		b.requests++
+		if failed {
+			b.failures++
+		}
+		if b.requests >= b.opts.MinRequests && float64(b.failures) >= b.opts.FailureRate*float64(b.requests) {
+			b.setState(BreakerOpen, now)
+		}
+	case BreakerHalfOpen:
+		if failed {
+			b.setState(BreakerOpen, now)
+		} else if b.successes++; b.successes >= b.opts.HalfOpenRequests {
+			b.setState(BreakerClosed, now)
+		}
+	}
+}
+
+// advance 处理随时间发生的状态变化: 打开超时进入半开, 关闭状态的统计窗口过期.
+func (b *Breaker) advance(now time.Time) {
+	switch b.state {
+	case BreakerOpen:
+		if now.Sub(b.openedAt) >= b.opts.OpenTimeout {
+			b.setState(BreakerHalfOpen, now)
+		}
+	case BreakerClosed:
+		if now.Sub(b.windowStart) >= b.opts.Window {
+			b.windowStart = now
+			b.requests, b.failures = 0, 0
+		}
+	}
+}
+
+func (b *Breaker) setState(state BreakerState, now time.Time) {
+	b.state = state
+	b.generation++
+	b.windowStart = now
+	b.requests, b.failures = 0, 0
+	b.probes, b.successes = 0, 0
+	if state == BreakerOpen {
+		b.openedAt = now
+	}
+}
+
+// limiter 限制同时进行的数据库操作数量.
+type limiter struct {
+	sem     chan struct{}
+	maxWait time.Duration
+}
+
+func (l *limiter) acquire(ctx context.Context) error {
+	select {
+	case l.sem <- struct{}{}:
+		return nil
+	default:
+	}
+	if l.maxWait <= 0 {
+		return ErrConcurrencyLimit
+	}
+
+	timer := time.NewTimer(l.maxWait)
+	defer timer.Stop()
+	select {
+	case l.sem <- struct{}{}:
+		return nil
+	case <-timer.C:
+		return ErrConcurrencyLimit
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *limiter) release() {
+	<-l.sem
+}
+
+// SetBreaker 设置熔断器, nil 表示不使用熔断器(默认).
+// 熔断器作用于创建 Stmt, ExecContext 等函数和 WithTx 的开始和提交; 打开时这些操作返回 ErrCircuitOpen.
+func (h *Handle) SetBreaker(b *Breaker) {
+	h.guardRWMutex.Lock()
+	defer h.guardRWMutex.Unlock()
+	h.breaker = b
+}
+
+// Breaker 返回 SetBreaker 设置的熔断器.
+func (h *Handle) Breaker() *Breaker {
+	h.guardRWMutex.RLock()
+	defer h.guardRWMutex.RUnlock()
+	return h.breaker
+}
+
+// SetConcurrencyLimit 限制同时进行的数据库操作数量, 作用范围同 SetBreaker, WithTx 在整个事务期间占用一个名额.
+// 达到上限时最多等待 maxWait, 仍然没有名额返回 ErrConcurrencyLimit; maxWait <= 0 表示不等待.
+// n <= 0 表示不限制(默认).
+func (h *Handle) SetConcurrencyLimit(n int, maxWait time.Duration) {
+	h.guardRWMutex.Lock()
+	defer h.guardRWMutex.Unlock()
+
+	if n <= 0 {
+		h.limiter = nil
+		return
+	}
+	h.limiter = &limiter{sem: make(chan struct{}, n), maxWait: maxWait}
+}
+
+// guard 在数据库操作之前检查并发限制和熔断器, 操作结束后必须用操作的结果调用返回的 done.
+func (h *Handle) guard(ctx context.Context) (done func(err error), err error) {
+	h.guardRWMutex.RLock()
+	b, l := h.breaker, h.limiter
+	h.guardRWMutex.RUnlock()
+
+	if l != nil {
+		if err = l.acquire(ctx); err != nil {
+			return nil, err
+		}
+	}
+	var generation uint64
+	if b != nil {
+		if generation, err = b.allow(); err != nil {
+			if l != nil {
+				l.release()
+			}
+			return nil, err
+		}
+	}
+
+	return func(err error) {
+		if b != nil {
+			b.done(generation, err)
+		}
+		if l != nil {
+			l.release()
+		}
+	}, nil
+}
+
+func SetBreaker(b *Breaker) {
+	defaultHandle.SetBreaker(b)
+}
+
+func SetConcurrencyLimit(n int, maxWait time.Duration) {
+	defaultHandle.SetConcurrencyLimit(n, maxWait)
+}
@@ -0,0 +1,143 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+var errBroken = errors.New("connection refused")
+
+func TestBreakerStateMachine(t *testing.T) {
+	b := NewBreaker(BreakerOptions{MinRequests: 4, FailureRate: 0.5, OpenTimeout: 20 * time.Millisecond})
+
+	record := func(err error) {
+		t.Helper()
+		generation, e := b.allow()
+		if e != nil {
+			t.Fatalf("allow: %v", e)
+		}
+		b.done(generation, err)
+	}
+
+	record(nil)
+	record(errBroken)
+	record(nil)
+	if b.State() != BreakerClosed {
+		t.Fatal("opened before MinRequests")
+	}
+	record(errBroken)
+	if b.State() != BreakerOpen {
+		t.Fatal("not opened at FailureRate")
+	}
+	if _, err := b.allow(); err != ErrCircuitOpen {
+		t.Fatalf("open breaker allowed a request: %v", err)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if b.State() != BreakerHalfOpen {
+		t.Fatal("not half-open after OpenTimeout")
+	}
+	generation, err := b.allow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = b.allow(); err != ErrCircuitOpen {
+		t.Fatal("half-open breaker allowed more than HalfOpenRequests probes")
+	}
+	b.done(generation, errBroken)
+	if b.State() != BreakerOpen {
+		t.Fatal("failed probe did not reopen")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	record(nil)
+	if b.State() != BreakerClosed {
+		t.Fatal("successful probe did not close")
+	}
+}
+
+func TestBreakerIgnoresStaleResults(t *testing.T) {
+	b := NewBreaker(BreakerOptions{MinRequests: 1, OpenTimeout: time.Hour})
+	stale, _ := b.allow()
+	generation, _ := b.allow()
+	b.done(generation, errBroken)
+	if b.State() != BreakerOpen {
+		t.Fatal("not opened")
+	}
+	b.done(stale, nil) // 打开之前放行的请求
+	if b.State() != BreakerOpen {
+		t.Fatal("result from the previous state changed the breaker")
+	}
+}
+
+func TestBreakerFailures(t *testing.T) {
+	for _, err := range []error{nil, context.Canceled} {
+		if IsBreakerFailure(err) {
+			t.Errorf("%v is a failure", err)
+		}
+	}
+	if !IsBreakerFailure(errBroken) {
+		t.Error("connection error is not a failure")
+	}
+}
+
+func TestGetStmtCacheHitSkipsBreaker(t *testing.T) {
+	d, fd := newFakeDB(t)
+	h := newHandle("test")
+	h.SetDB(d)
+	b := NewBreaker(BreakerOptions{MinRequests: 1, OpenTimeout: 20 * time.Millisecond})
+	h.SetBreaker(b)
+
+	if _, err := h.GetStmt("UPDATE t SET a=1"); err != nil {
+		t.Fatal(err)
+	}
+
+	fd.setFail(func(op, query string) error { return errBroken })
+	if _, err := h.ExecContext(context.Background(), "UPDATE t SET b=1"); err != errBroken {
+		t.Fatalf("err = %v", err)
+	}
+	if b.State() != BreakerOpen {
+		t.Fatal("breaker is not open")
+	}
+	fd.setFail(nil)
+
+	time.Sleep(30 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		if _, err := h.GetStmt("UPDATE t SET a=1"); err != nil {
+			t.Fatalf("cache hit: %v", err)
+		}
+	}
+	if b.State() != BreakerHalfOpen {
+		t.Fatal("cache hits changed the half-open breaker")
+	}
+	if _, err := h.ExecContext(context.Background(), "UPDATE t SET a=1"); err != nil {
+		t.Fatalf("probe was used up by cache hits: %v", err)
+	}
+	if b.State() != BreakerClosed {
+		t.Fatal("successful probe did not close")
+	}
+}
+
+func TestWithTxPanicIsFailure(t *testing.T) {
+	d, _ := newFakeDB(t)
+	h := newHandle("test")
+	h.SetDB(d)
+	b := NewBreaker(BreakerOptions{MinRequests: 1, OpenTimeout: time.Hour})
+	h.SetBreaker(b)
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("panic is not propagated")
+			}
+		}()
+		h.WithTx(context.Background(), nil, func(tx *Tx) error {
+			panic("boom")
+		})
+	}()
+	if b.State() != BreakerOpen {
+		t.Error("panic in WithTx is recorded as a success")
+	}
+}
@@ -0,0 +1,139 @@
+package db
+
+import (
+	"sync"
+	"time"
+)
+
+// CleanPolicy 是 Cleaner 每次清理时关闭哪些 Stmt 的策略.
+type CleanPolicy int
+
+const (
+	CleanAll       CleanPolicy = iota // 关闭所有缓存的 Stmt
+	CleanIdle                         // 只关闭空闲超过 CleanerOptions.IdleTime 的 Stmt
+	CleanLeastUsed                    // 关闭上次清理之后使用次数最少的 CleanerOptions.Fraction 比例的 Stmt
+)
+
+// CleanerOptions 设置 Cleaner 的清理周期和策略.
+type CleanerOptions struct {
+	// Interval 清理周期, <= 0 时使用 12 小时.
+	Interval time.Duration
+
+	Policy CleanPolicy
+
+	// IdleTime 用于 CleanIdle, <= 0 时使用 Interval.
+	IdleTime time.Duration
+
+	// Fraction 用于 CleanLeastUsed, 取值 (0, 1], 超出范围时使用 0.5.
+	Fraction float64
+}
+
+// Cleaner 周期性地清理 Handle 缓存的 Stmt, 使用 Handle.StartCleaner 创建.
+type Cleaner struct {
+	h        *Handle
+	opts     CleanerOptions
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+func newCleaner(h *Handle, opts CleanerOptions) *Cleaner {
+	if opts.Interval <= 0 {
+		opts.Interval = time.Hour * 12
+	}
+	if opts.IdleTime <= 0 {
+		opts.IdleTime = opts.Interval
+	}
+	if opts.Fraction <= 0 || opts.Fraction > 1 {
+		opts.Fraction = 0.5
+	}
+	return &Cleaner{
+		h:    h,
+		opts: opts,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+}
+
+func (c *Cleaner) run() {
+	defer close(c.done)
+
+	ticker := time.NewTicker(c.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			for _, n := range c.h.nodes() {
+				n.clean(c.opts)
+			}
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// Stop 停止清理并等待清理的 goroutine 退出, 可以多次调用.
+func (c *Cleaner) Stop() {
+	c.stopOnce.Do(func() {
+		close(c.stop)
+	})
+	<-c.done
+}
+
+// Running 返回 Cleaner 是否还在运行.
+func (c *Cleaner) Running() bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+		return true
+	}
+}
+
+func (c *Cleaner) Options() CleanerOptions {
+	return c.opts
+}
+
+// StartCleaner 启动周期性清理 Stmt 的 Cleaner, 之前启动的 Cleaner 会被停止.
+// CloseDB 会停止 Cleaner.
+func (h *Handle) StartCleaner(opts CleanerOptions) *Cleaner {
+	c := newCleaner(h, opts)
+
+	h.cleanerMutex.Lock()
+	old := h.cleaner
+	h.cleaner = c
+	h.cleanerMutex.Unlock()
+
+	if old != nil {
+		old.Stop()
+	}
+	go c.run()
+	return c
+}
+
+// StopCleaner 停止 StartCleaner 启动的 Cleaner, 没有启动时什么也不做.
+func (h *Handle) StopCleaner() {
+	h.cleanerMutex.Lock()
+	c := h.cleaner
+	h.cleaner = nil
+	h.cleanerMutex.Unlock()
+
+	if c != nil {
+		c.Stop()
+	}
+}
+
+// Cleaner 返回正在运行的 Cleaner, 没有时返回 nil.
+func (h *Handle) Cleaner() *Cleaner {
+	h.cleanerMutex.Lock()
+	defer h.cleanerMutex.Unlock()
+	return h.cleaner
+}
+
+// CleanStatement 启动每 12 小时关闭所有 Stmt 的 Cleaner, 等价于
+//
+//	StartCleaner(CleanerOptions{Interval: time.Hour * 12, Policy: CleanAll})
+func (h *Handle) CleanStatement() {
+	h.StartCleaner(CleanerOptions{Interval: time.Hour * 12, Policy: CleanAll})
+}
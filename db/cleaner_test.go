@@ -0,0 +1,66 @@
+package db
+
+import (
+	"testing"
+	"time"
+)
+
+// startCleaner 启动 Cleaner 并在测试结束时停止, 避免清理的 goroutine 比测试活得更久.
+func startCleaner(t *testing.T, h *Handle, opts CleanerOptions) *Cleaner {
+	c := h.StartCleaner(opts)
+	t.Cleanup(h.StopCleaner)
+	return c
+}
+
+func TestCleanerCleans(t *testing.T) {
+	d, fd := newFakeDB(t)
+	h := newHandle("test")
+	h.SetCacheOptions(CacheOptions{})
+	h.SetDB(d)
+
+	if _, err := h.GetStmt("UPDATE t SET a=1"); err != nil {
+		t.Fatal(err)
+	}
+	startCleaner(t, h, CleanerOptions{Interval: 5 * time.Millisecond, Policy: CleanAll})
+
+	deadline := time.Now().Add(time.Second)
+	for fd.count("close UPDATE t SET a=1") == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("cleaner did not close the cached stmt")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCleanerStop(t *testing.T) {
+	h := newHandle("test")
+	first := startCleaner(t, h, CleanerOptions{Interval: time.Hour})
+	second := startCleaner(t, h, CleanerOptions{Interval: time.Hour})
+
+	if first.Running() {
+		t.Error("StartCleaner did not stop the previous cleaner")
+	}
+	if h.Cleaner() != second || !second.Running() {
+		t.Fatal("second cleaner is not running")
+	}
+
+	h.StopCleaner()
+	if second.Running() || h.Cleaner() != nil {
+		t.Error("StopCleaner did not stop the cleaner")
+	}
+	second.Stop() // 可以多次调用
+}
+
+func TestCloseDBStopsCleaner(t *testing.T) {
+	d, _ := newFakeDB(t)
+	h := newHandle("test")
+	h.SetDB(d)
+	c := startCleaner(t, h, CleanerOptions{Interval: time.Hour})
+
+	if err := h.CloseDB(); err != nil {
+		t.Fatal(err)
+	}
+	if c.Running() {
+		t.Error("CloseDB did not stop the cleaner")
+	}
+}
@@ -0,0 +1,382 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"gopkg.in/yaml.v2"
+)
+
+// Config 是创建数据库句柄的配置, 可以从环境变量, JSON 或者 YAML 读取, 见 Open.
+//
+// DSN 和 Host 等分开的字段二选一, 设置了 DSN 时忽略 Host, Port, User, Password, Database 和 Params.
+type Config struct {
+	Name   string `json:"name" yaml:"name" env:"NAME"` // 句柄的名字, 默认是 DefaultName
+	Driver string `json:"driver" yaml:"driver" env:"DRIVER"`
+	DSN    string `json:"dsn" yaml:"dsn" env:"DSN"`
+
+	Host     string            `json:"host" yaml:"host" env:"HOST"`
+	Port     int               `json:"port" yaml:"port" env:"PORT"`
+	User     string            `json:"user" yaml:"user" env:"USER"`
+	Password string            `json:"password" yaml:"password" env:"PASSWORD"`
+	Database string            `json:"database" yaml:"database" env:"DATABASE"`
+	Params   map[string]string `json:"params" yaml:"params"`
+
+	// Replicas 是从库的 DSN, 见 Handle.SetReplicas.
+	Replicas []string `json:"replicas" yaml:"replicas" env:"REPLICAS"`
+
+	MaxOpenConns    int      `json:"max_open_conns" yaml:"max_open_conns" env:"MAX_OPEN_CONNS"`
+	MaxIdleConns    int      `json:"max_idle_conns" yaml:"max_idle_conns" env:"MAX_IDLE_CONNS"`
+	ConnMaxLifetime Duration `json:"conn_max_lifetime" yaml:"conn_max_lifetime" env:"CONN_MAX_LIFETIME"`
+	ConnMaxIdleTime Duration `json:"conn_max_idle_time" yaml:"conn_max_idle_time" env:"CONN_MAX_IDLE_TIME"`
+
+	// PingTimeout 是 Open 时 ping 数据库的超时时间, 默认 5 秒.
+	PingTimeout Duration `json:"ping_timeout" yaml:"ping_timeout" env:"PING_TIMEOUT"`
+
+	// StmtCacheSize 是 CacheOptions.MaxSize, 0 表示使用 DefaultCacheOptions, < 0 表示不限制.
+	StmtCacheSize   int      `json:"stmt_cache_size" yaml:"stmt_cache_size" env:"STMT_CACHE_SIZE"`
+	StmtIdleTimeout Duration `json:"stmt_idle_timeout" yaml:"stmt_idle_timeout" env:"STMT_IDLE_TIMEOUT"`
+
+	// CleanInterval > 0 时启动 Cleaner, CleanPolicy 是 "all", "idle" 或者 "least_used", 默认 "all".
+	CleanInterval Duration `json:"clean_interval" yaml:"clean_interval" env:"CLEAN_INTERVAL"`
+	CleanPolicy   string   `json:"clean_policy" yaml:"clean_policy" env:"CLEAN_POLICY"`
+}
+
+// Duration 是可以从 "30s", "1h" 这样的字符串或者表示秒数的整数读取的 time.Duration.
+type Duration time.Duration
+
+func (d *Duration) parse(s string) error {
+	if s == "" {
+		*d = 0
+		return nil
+	}
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		*d = Duration(time.Duration(secs) * time.Second)
+		return nil
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		s = string(data)
+	}
+	return d.parse(s)
+}
+
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	return d.parse(s)
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+var durationType = reflect.TypeOf(Duration(0))
+
+// LoadConfigEnv 从环境变量读取配置, 变量名是 prefix 加上 Config 字段的 env tag, 比如
+// prefix 为 "DB_" 时读取 DB_DRIVER, DB_DSN, DB_MAX_OPEN_CONNS 等;
+// Replicas 使用逗号分隔, Params 不能从环境变量读取.
+func LoadConfigEnv(prefix string) (*Config, error) {
+	cfg := &Config{}
+	v := reflect.ValueOf(cfg).Elem()
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		key := t.Field(i).Tag.Get("env")
+		if key == "" {
+			continue
+		}
+		s, ok := os.LookupEnv(prefix + key)
+		if !ok {
+			continue
+		}
+
+		field := v.Field(i)
+		var err error
+		switch {
+		case field.Type() == durationType:
+			err = field.Addr().Interface().(*Duration).parse(s)
+		case field.Kind() == reflect.String:
+			field.SetString(s)
+		case field.Kind() == reflect.Int:
+			var n int64
+			if n, err = strconv.ParseInt(s, 10, 64); err == nil {
+				field.SetInt(n)
+			}
+		case field.Kind() == reflect.Slice:
+			var items []string
+			for _, item := range strings.Split(s, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					items = append(items, item)
+				}
+			}
+			field.Set(reflect.ValueOf(items))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("db: invalid %s%s %q: %v", prefix, key, s, err)
+		}
+	}
+	return cfg, nil
+}
+
+// LoadConfigFile 读取 JSON 或者 YAML 格式的配置文件, 根据扩展名 .json, .yaml, .yml 判断格式.
+func LoadConfigFile(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return ParseConfigJSON(data)
+	case ".yaml", ".yml":
+		return ParseConfigYAML(data)
+	}
+	return nil, fmt.Errorf("db: unknown config file format: %s", path)
+}
+
+func ParseConfigJSON(data []byte) (*Config, error) {
+	cfg := &Config{}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func ParseConfigYAML(data []byte) (*Config, error) {
+	cfg := &Config{}
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Validate 检查配置是否完整和有效.
+func (cfg *Config) Validate() error {
+	if cfg.Driver == "" {
+		return errors.New("db: config: driver is required")
+	}
+	if cfg.DSN == "" && cfg.Host == "" {
+		return errors.New("db: config: dsn or host is required")
+	}
+	if cfg.Port < 0 || cfg.Port > 65535 {
+		return fmt.Errorf("db: config: invalid port %d", cfg.Port)
+	}
+	if cfg.MaxOpenConns < 0 || cfg.MaxIdleConns < 0 {
+		return errors.New("db: config: max_open_conns and max_idle_conns must not be negative")
+	}
+	if cfg.MaxOpenConns > 0 && cfg.MaxIdleConns > cfg.MaxOpenConns {
+		return fmt.Errorf("db: config: max_idle_conns %d is greater than max_open_conns %d", cfg.MaxIdleConns, cfg.MaxOpenConns)
+	}
+	if cfg.ConnMaxLifetime < 0 || cfg.ConnMaxIdleTime < 0 || cfg.PingTimeout < 0 ||
+		cfg.StmtIdleTimeout < 0 || cfg.CleanInterval < 0 {
+		return errors.New("db: config: durations must not be negative")
+	}
+	if _, err := cfg.cleanPolicy(); err != nil {
+		return err
+	}
+	if cfg.DSN == "" {
+		if _, err := cfg.buildDSN(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DataSourceName 返回 DSN, 没有设置时根据 Host 等字段拼出来.
+func (cfg *Config) DataSourceName() (string, error) {
+	if cfg.DSN != "" {
+		return cfg.DSN, nil
+	}
+	return cfg.buildDSN()
+}
+
+func (cfg *Config) buildDSN() (string, error) {
+	switch cfg.Driver {
+	case "mysql":
+		addr := cfg.Host
+		if cfg.Port > 0 {
+			addr = net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port))
+		}
+		dsn := fmt.Sprintf("%s:%s@tcp(%s)/%s", cfg.User, cfg.Password, addr, cfg.Database)
+		if len(cfg.Params) > 0 {
+			params := url.Values{}
+			for k, v := range cfg.Params {
+				params.Set(k, v)
+			}
+			dsn += "?" + params.Encode()
+		}
+		return dsn, nil
+	case "postgres", "pgx":
+		parts := []string{"host=" + quoteDSNValue(cfg.Host)}
+		if cfg.Port > 0 {
+			parts = append(parts, "port="+strconv.Itoa(cfg.Port))
+		}
+		if cfg.User != "" {
+			parts = append(parts, "user="+quoteDSNValue(cfg.User))
+		}
+		if cfg.Password != "" {
+			parts = append(parts, "password="+quoteDSNValue(cfg.Password))
+		}
+		if cfg.Database != "" {
+			parts = append(parts, "dbname="+quoteDSNValue(cfg.Database))
+		}
+		keys := make([]string, 0, len(cfg.Params))
+		for k := range cfg.Params {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			parts = append(parts, k+"="+quoteDSNValue(cfg.Params[k]))
+		}
+		return strings.Join(parts, " "), nil
+	}
+	return "", fmt.Errorf("db: config: dsn is required for driver %q", cfg.Driver)
+}
+
+// quoteDSNValue 按照 libpq 的 key=value 格式转义 value.
+func quoteDSNValue(v string) string {
+	if v != "" && !strings.ContainsAny(v, ` '\`) {
+		return v
+	}
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(v) + "'"
+}
+
+func (cfg *Config) cleanPolicy() (CleanPolicy, error) {
+	switch cfg.CleanPolicy {
+	case "", "all":
+		return CleanAll, nil
+	case "idle":
+		return CleanIdle, nil
+	case "least_used":
+		return CleanLeastUsed, nil
+	}
+	return 0, fmt.Errorf("db: config: unknown clean_policy %q", cfg.CleanPolicy)
+}
+
+func (cfg *Config) cacheOptions() CacheOptions {
+	opts := DefaultCacheOptions
+	if cfg.StmtCacheSize != 0 {
+		opts.MaxSize = cfg.StmtCacheSize
+	}
+	opts.IdleTimeout = time.Duration(cfg.StmtIdleTimeout)
+	return opts
+}
+
+func (cfg *Config) open(dsn string, pingTimeout time.Duration) (*sqlx.DB, error) {
+	d, err := sqlx.Open(cfg.Driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	// 没有设置的字段保留 database/sql 的默认值, 比如 SetMaxIdleConns(0) 会关闭所有空闲连接
+	if cfg.MaxOpenConns > 0 {
+		d.SetMaxOpenConns(cfg.MaxOpenConns)
+	}
+	if cfg.MaxIdleConns > 0 {
+		d.SetMaxIdleConns(cfg.MaxIdleConns)
+	}
+	if cfg.ConnMaxLifetime > 0 {
+		d.SetConnMaxLifetime(time.Duration(cfg.ConnMaxLifetime))
+	}
+	if cfg.ConnMaxIdleTime > 0 {
+		d.SetConnMaxIdleTime(time.Duration(cfg.ConnMaxIdleTime))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+	defer cancel()
+	if err = d.PingContext(ctx); err != nil {
+		d.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// Open 检查配置, 创建主库和从库的 sqlx.DB 并 ping, 成功后安装到名字为 cfg.Name 的句柄上,
+// 设置 Stmt 缓存并按照 CleanInterval 启动或者停止 Cleaner.
+// 句柄上已经有数据库时(重新加载配置), 替换之后关闭之前的主库和从库以及它们缓存的 Stmt.
+//
+//	cfg, err := db.LoadConfigEnv("DB_")
+//	if err != nil {
+//		return err
+//	}
+//	if _, err = db.Open(cfg); err != nil {
+//		return err
+//	}
+func Open(cfg *Config) (*Handle, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	dsn, err := cfg.DataSourceName()
+	if err != nil {
+		return nil, err
+	}
+	pingTimeout := time.Duration(cfg.PingTimeout)
+	if pingTimeout <= 0 {
+		pingTimeout = time.Second * 5
+	}
+
+	primary, err := cfg.open(dsn, pingTimeout)
+	if err != nil {
+		return nil, err
+	}
+	replicas := make([]*sqlx.DB, 0, len(cfg.Replicas))
+	for _, replicaDSN := range cfg.Replicas {
+		replica, err := cfg.open(replicaDSN, pingTimeout)
+		if err != nil {
+			primary.Close()
+			for _, d := range replicas {
+				d.Close()
+			}
+			return nil, err
+		}
+		replicas = append(replicas, replica)
+	}
+
+	name := cfg.Name
+	if name == "" {
+		name = DefaultName
+	}
+	h := Use(name)
+	oldPrimary, oldReplicas := h.GetDB(), h.GetReplicas()
+	h.SetDB(primary)
+	h.SetReplicas(replicas...)
+	// 重新加载配置时关闭之前的连接池, 正在执行的语句结束之后才会真正关闭
+	for _, d := range append(oldReplicas, oldPrimary) {
+		if d != nil {
+			d.Close()
+		}
+	}
+	h.SetCacheOptions(cfg.cacheOptions())
+	if cfg.CleanInterval > 0 {
+		policy, _ := cfg.cleanPolicy()
+		h.StartCleaner(CleanerOptions{Interval: time.Duration(cfg.CleanInterval), Policy: policy})
+	} else {
+		// 重新加载的配置不再清理时停止之前的 Cleaner
+		h.StopCleaner()
+	}
+	return h, nil
+}
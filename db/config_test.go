@@ -0,0 +1,192 @@
+package db
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestOpenKeepsPoolDefaults(t *testing.T) {
+	h, err := Open(&Config{Name: "test-defaults", Driver: "fakedb", DSN: "primary"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.CloseDB()
+
+	if _, err = h.GetDB().ExecContext(context.Background(), "UPDATE t SET a=1"); err != nil {
+		t.Fatal(err)
+	}
+	if stats := h.GetDB().Stats(); stats.Idle != 1 {
+		t.Errorf("idle connections = %d, unset max_idle_conns should keep the default", stats.Idle)
+	}
+}
+
+func TestOpenReloadClosesOldPools(t *testing.T) {
+	cfg := &Config{Name: "test-reload", Driver: "fakedb", DSN: "primary", Replicas: []string{"replica"}}
+	h, err := Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.CloseDB()
+	oldPrimary, oldReplica := h.GetDB(), h.GetReplicas()[0]
+	if _, err = h.GetStmt("UPDATE t SET a=1"); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.ConnMaxLifetime = Duration(time.Minute)
+	if _, err = Open(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if h.GetDB() == oldPrimary {
+		t.Fatal("primary is not replaced")
+	}
+	ctx := context.Background()
+	if oldPrimary.PingContext(ctx) == nil || oldReplica.PingContext(ctx) == nil {
+		t.Error("old pools are not closed")
+	}
+	if n := h.primaryNode().stmtSet.len(); n != 0 {
+		t.Errorf("stmts prepared on the old primary are still cached: %d", n)
+	}
+	if _, err = h.ExecContext(ctx, "UPDATE t SET a=1"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpenReloadStopsCleaner(t *testing.T) {
+	cfg := &Config{Name: "test-reload-cleaner", Driver: "fakedb", DSN: "primary", CleanInterval: Duration(time.Hour)}
+	h, err := Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.CloseDB()
+	c := h.Cleaner()
+	if c == nil || !c.Running() {
+		t.Fatal("cleaner is not started")
+	}
+
+	cfg.CleanInterval = 0
+	if _, err = Open(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if h.Cleaner() != nil || c.Running() {
+		t.Error("cleaner of the previous config is still running")
+	}
+}
+
+func TestLoadConfigEnv(t *testing.T) {
+	t.Setenv("TEST_DB_DRIVER", "mysql")
+	t.Setenv("TEST_DB_HOST", "db.local")
+	t.Setenv("TEST_DB_PORT", "3307")
+	t.Setenv("TEST_DB_REPLICAS", "r1, r2,,")
+	t.Setenv("TEST_DB_CONN_MAX_LIFETIME", "90")
+	t.Setenv("TEST_DB_STMT_IDLE_TIMEOUT", "1m30s")
+
+	cfg, err := LoadConfigEnv("TEST_DB_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Config{
+		Driver:          "mysql",
+		Host:            "db.local",
+		Port:            3307,
+		Replicas:        []string{"r1", "r2"},
+		ConnMaxLifetime: Duration(90 * time.Second),
+		StmtIdleTimeout: Duration(90 * time.Second),
+	}
+	if !reflect.DeepEqual(cfg, want) {
+		t.Errorf("cfg = %+v, want %+v", cfg, want)
+	}
+
+	for key, value := range map[string]string{"TEST_DB_BAD_PORT": "x", "TEST_DB_BAD_PING_TIMEOUT": "soon"} {
+		t.Setenv(key, value)
+	}
+	if _, err := LoadConfigEnv("TEST_DB_BAD_"); err == nil {
+		t.Error("invalid value: no error")
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	want := &Config{
+		Driver:        "postgres",
+		Host:          "db.local",
+		Params:        map[string]string{"sslmode": "disable"},
+		PingTimeout:   Duration(2 * time.Second),
+		CleanInterval: Duration(time.Hour),
+		CleanPolicy:   "idle",
+	}
+
+	cfg, err := ParseConfigJSON([]byte(`{"driver": "postgres", "host": "db.local", "params": {"sslmode": "disable"},
+		"ping_timeout": 2, "clean_interval": "1h", "clean_policy": "idle"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cfg, want) {
+		t.Errorf("JSON: cfg = %+v, want %+v", cfg, want)
+	}
+
+	cfg, err = ParseConfigYAML([]byte("driver: postgres\nhost: db.local\nparams:\n  sslmode: disable\nping_timeout: 2\nclean_interval: 1h\nclean_policy: idle\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cfg, want) {
+		t.Errorf("YAML: cfg = %+v, want %+v", cfg, want)
+	}
+
+	if _, err := ParseConfigJSON([]byte(`{"ping_timeout": "soon"}`)); err == nil {
+		t.Error("JSON: invalid duration: no error")
+	}
+	if _, err := ParseConfigYAML([]byte("ping_timeout: soon\n")); err == nil {
+		t.Error("YAML: invalid duration: no error")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := Config{Driver: "mysql", Host: "db.local"}
+	if err := valid.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]func(cfg *Config){
+		"no driver":         func(cfg *Config) { cfg.Driver = "" },
+		"no dsn or host":    func(cfg *Config) { cfg.Host = "" },
+		"bad port":          func(cfg *Config) { cfg.Port = 70000 },
+		"negative conns":    func(cfg *Config) { cfg.MaxOpenConns = -1 },
+		"idle over open":    func(cfg *Config) { cfg.MaxOpenConns, cfg.MaxIdleConns = 2, 3 },
+		"negative duration": func(cfg *Config) { cfg.CleanInterval = Duration(-time.Second) },
+		"unknown policy":    func(cfg *Config) { cfg.CleanPolicy = "lru" },
+		"host for sqlite":   func(cfg *Config) { cfg.Driver = "sqlite3" },
+	}
+	for name, modify := range tests {
+		cfg := valid
+		modify(&cfg)
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+func TestDataSourceName(t *testing.T) {
+	tests := []struct {
+		cfg  Config
+		want string
+	}{
+		{Config{Driver: "sqlite3", DSN: "file:test.db"}, "file:test.db"},
+		{Config{Driver: "mysql", Host: "db.local", Port: 3306, User: "u", Password: "p", Database: "app",
+			Params: map[string]string{"parseTime": "true", "charset": "utf8mb4"}},
+			"u:p@tcp(db.local:3306)/app?charset=utf8mb4&parseTime=true"},
+		{Config{Driver: "mysql", Host: "::1", Port: 3306, Database: "app"}, ":@tcp([::1]:3306)/app"},
+		{Config{Driver: "postgres", Host: "db.local", Port: 5432, User: "u", Password: "it's a secret", Database: "app",
+			Params: map[string]string{"sslmode": "disable", "application_name": "my app"}},
+			`host=db.local port=5432 user=u password='it\'s a secret' dbname=app application_name='my app' sslmode=disable`},
+		{Config{Driver: "pgx", Host: "db.local"}, "host=db.local"},
+	}
+	for _, tt := range tests {
+		got, err := tt.cfg.DataSourceName()
+		if err != nil {
+			t.Errorf("%s: %v", tt.cfg.Driver, err)
+		} else if got != tt.want {
+			t.Errorf("%s: dsn = %q, want %q", tt.cfg.Driver, got, tt.want)
+		}
+	}
+}
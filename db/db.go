@@ -1,117 +1,79 @@
 // 读取配置, 创建全局的 sqlx.DB 对象, 根据 query 创建 Stmt 对象并缓存该对象.
 //
 // Stmt 对象维持了"没有关闭的数据库连接"的 driver.Stmt 对象, 这个是轻资源, 并不会维持连接不关闭;
-// 如果这些轻资源会有很大的负面影响, 可以考虑 LRU, 不过目前我觉得还没有必要.
+// 但是 query 由 Filter 动态拼接时数量没有上限, 所以 Stmt 缓存是有容量上限的 LRU, 见 CacheOptions.
+//
+// 包级别的函数都作用于名字为 DefaultName 的句柄, 访问其他数据库使用 Use 返回的 Handle.
+// 配置的读取见 Config 和 Open.
 package db
 
 import (
-	"sync"
+	"context"
 
 	"github.com/jmoiron/sqlx"
-	"time"
-)
-
-var (
-	db *sqlx.DB
-
-	stmtSetRWMutex sync.RWMutex
-	stmtSet        = make(map[string]*sqlx.Stmt) // map[query]*sqlx.Stmt
-
-	namedStmtSetRWMutex sync.RWMutex
-	namedStmtSet        = make(map[string]*sqlx.NamedStmt) // map[query]*sqlx.NamedStmt
-
-	ticker *time.Ticker
 )
 
 func SetDB(d *sqlx.DB) {
-	db = d
+	defaultHandle.SetDB(d)
 }
 
 func GetDB() *sqlx.DB {
-	return db
+	return defaultHandle.GetDB()
 }
 
 // CloseDB 关闭数据库连接, 释放资源.
-// 一般情况下没有必要调用该函数.
+// 一般情况下没有必要调用该函数; 需要等待正在执行的语句结束时使用 Shutdown.
 func CloseDB() error {
-	return db.Close()
+	return defaultHandle.CloseDB()
+}
+
+// SetCacheOptions 设置 Stmt 缓存的容量和淘汰策略, 同时作用于 GetStmt 和 GetNamedStmt 的缓存.
+// 缩小容量会立即淘汰多出来的 Stmt.
+func SetCacheOptions(opts CacheOptions) {
+	defaultHandle.SetCacheOptions(opts)
 }
 
 // CloseAllStmt 关闭所有缓存的 Stmt, 释放资源.
 // 一般情况下没有必要调用该函数.
 func CloseAllStmt() {
-	func() {
-		stmtSetRWMutex.Lock()
-		defer stmtSetRWMutex.Unlock()
-		for _, stmt := range stmtSet {
-			stmt.Close()
-		}
-		stmtSet = make(map[string]*sqlx.Stmt)
-	}()
-
-	func() {
-		namedStmtSetRWMutex.Lock()
-		defer namedStmtSetRWMutex.Unlock()
-		for _, stmt := range namedStmtSet {
-			stmt.Close()
-		}
-		namedStmtSet = make(map[string]*sqlx.NamedStmt)
-	}()
+	defaultHandle.CloseAllStmt()
 }
 
 func GetStmt(query string) (stmt *sqlx.Stmt, err error) {
-	stmtSetRWMutex.RLock()
-	stmt = stmtSet[query]
-	stmtSetRWMutex.RUnlock()
-
-	if stmt != nil {
-		return
-	}
-
-	stmtSetRWMutex.Lock()
-	defer stmtSetRWMutex.Unlock()
-
-	if stmt = stmtSet[query]; stmt != nil {
-		return
-	}
-
-	stmt, err = db.Preparex(query)
-	if err != nil {
-		return
-	}
-	stmtSet[query] = stmt
-	return
+	return defaultHandle.GetStmt(query)
 }
 
 func GetNamedStmt(query string) (stmt *sqlx.NamedStmt, err error) {
-	namedStmtSetRWMutex.RLock()
-	stmt = namedStmtSet[query]
-	namedStmtSetRWMutex.RUnlock()
-
-	if stmt != nil {
-		return
-	}
-
-	namedStmtSetRWMutex.Lock()
-	defer namedStmtSetRWMutex.Unlock()
-
-	if stmt = namedStmtSet[query]; stmt != nil {
-		return
-	}
-
-	stmt, err = db.PrepareNamed(query)
-	if err != nil {
-		return
-	}
-	namedStmtSet[query] = stmt
-	return
+	return defaultHandle.GetNamedStmt(query)
+}
+
+func GetStmtContext(ctx context.Context, query string) (stmt *sqlx.Stmt, err error) {
+	return defaultHandle.GetStmtContext(ctx, query)
 }
 
+func GetNamedStmtContext(ctx context.Context, query string) (stmt *sqlx.NamedStmt, err error) {
+	return defaultHandle.GetNamedStmtContext(ctx, query)
+}
+
+// SetReplicas 设置默认句柄的从库, 见 Handle.SetReplicas.
+func SetReplicas(replicas ...*sqlx.DB) {
+	defaultHandle.SetReplicas(replicas...)
+}
+
+// SetBalance 设置默认句柄在多个从库之间选择的策略.
+func SetBalance(b Balance) {
+	defaultHandle.SetBalance(b)
+}
+
+// CleanStatement 启动默认句柄每 12 小时关闭所有 Stmt 的 Cleaner, 见 Handle.StartCleaner.
 func CleanStatement() {
-	ticker = time.NewTicker(time.Hour * 12)
-	go func () {
-		for _ = range ticker.C {
-			CloseAllStmt()
-		}
-	}()
-}
\ No newline at end of file
+	defaultHandle.CleanStatement()
+}
+
+func StartCleaner(opts CleanerOptions) *Cleaner {
+	return defaultHandle.StartCleaner(opts)
+}
+
+func StopCleaner() {
+	defaultHandle.StopCleaner()
+}
@@ -0,0 +1,38 @@
+package db
+
+import (
+	"errors"
+	"reflect"
+)
+
+// mysqlErrorNumber 返回 github.com/go-sql-driver/mysql 的 *MySQLError 中的错误码.
+// 通过反射读取, 这样 db 包不需要依赖 mysql 驱动.
+func mysqlErrorNumber(err error) (uint16, bool) {
+	for ; err != nil; err = errors.Unwrap(err) {
+		v := reflect.Indirect(reflect.ValueOf(err))
+		if v.Kind() != reflect.Struct || v.Type().Name() != "MySQLError" {
+			continue
+		}
+		if f := v.FieldByName("Number"); f.IsValid() && f.Kind() == reflect.Uint16 {
+			return uint16(f.Uint()), true
+		}
+	}
+	return 0, false
+}
+
+// postgresErrorCode 返回 github.com/lib/pq 的 *pq.Error 或者 pgx 的 *pgconn.PgError 中的 SQLSTATE.
+func postgresErrorCode(err error) (string, bool) {
+	for ; err != nil; err = errors.Unwrap(err) {
+		v := reflect.Indirect(reflect.ValueOf(err))
+		if v.Kind() != reflect.Struct {
+			continue
+		}
+		if name := v.Type().Name(); name != "Error" && name != "PgError" {
+			continue
+		}
+		if f := v.FieldByName("Code"); f.IsValid() && f.Kind() == reflect.String {
+			return f.String(), true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,188 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// 下面的函数使用缓存的 Stmt 执行 query, ctx 同时作用于创建 Stmt 和执行语句;
+// 路由规则同 GetStmtContext, 执行前后会调用 Handle 的 Hook.
+
+func (h *Handle) ExecContext(ctx context.Context, query string, args ...interface{}) (result sql.Result, err error) {
+	err = h.withStmt(ctx, query, args, func(ctx context.Context, stmt *sqlx.Stmt) (err error) {
+		result, err = stmt.ExecContext(ctx, args...)
+		return
+	})
+	return
+}
+
+// QueryContext 执行 query 并返回 Rows, 调用者必须关闭返回的 Rows.
+func (h *Handle) QueryContext(ctx context.Context, query string, args ...interface{}) (rows *sqlx.Rows, err error) {
+	err = h.withStmt(ctx, query, args, func(ctx context.Context, stmt *sqlx.Stmt) (err error) {
+		rows, err = stmt.QueryxContext(ctx, args...)
+		return
+	})
+	return
+}
+
+// GetContext 执行 query 并把第一行结果 scan 到 dest, 没有结果时返回 sql.ErrNoRows.
+func (h *Handle) GetContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	return h.withStmt(ctx, query, args, func(ctx context.Context, stmt *sqlx.Stmt) error {
+		return stmt.GetContext(ctx, dest, args...)
+	})
+}
+
+// SelectContext 执行 query 并把所有结果 scan 到 dest, dest 必须是 slice 的指针.
+func (h *Handle) SelectContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	return h.withStmt(ctx, query, args, func(ctx context.Context, stmt *sqlx.Stmt) error {
+		return stmt.SelectContext(ctx, dest, args...)
+	})
+}
+
+func (h *Handle) NamedExecContext(ctx context.Context, query string, arg interface{}) (result sql.Result, err error) {
+	err = h.withNamedStmt(ctx, query, arg, func(ctx context.Context, stmt *sqlx.NamedStmt) (err error) {
+		result, err = stmt.ExecContext(ctx, arg)
+		return
+	})
+	return
+}
+
+// NamedQueryContext 执行 query 并返回 Rows, 调用者必须关闭返回的 Rows.
+func (h *Handle) NamedQueryContext(ctx context.Context, query string, arg interface{}) (rows *sqlx.Rows, err error) {
+	err = h.withNamedStmt(ctx, query, arg, func(ctx context.Context, stmt *sqlx.NamedStmt) (err error) {
+		rows, err = stmt.QueryxContext(ctx, arg)
+		return
+	})
+	return
+}
+
+func (h *Handle) NamedGetContext(ctx context.Context, dest interface{}, query string, arg interface{}) error {
+	return h.withNamedStmt(ctx, query, arg, func(ctx context.Context, stmt *sqlx.NamedStmt) error {
+		return stmt.GetContext(ctx, dest, arg)
+	})
+}
+
+func (h *Handle) NamedSelectContext(ctx context.Context, dest interface{}, query string, arg interface{}) error {
+	return h.withNamedStmt(ctx, query, arg, func(ctx context.Context, stmt *sqlx.NamedStmt) error {
+		return stmt.SelectContext(ctx, dest, arg)
+	})
+}
+
+// withStmt 取得 query 对应的 Stmt 并执行 fn, 前后调用 Hook; 只读的 query 按照 RetryPolicy 重试, 每次重试都调用 Hook.
+// 如果 fn 返回的错误表示 Stmt 已经失效, 删除缓存的 Stmt, 重新创建并重试一次, 见 RegisterStmtInvalidator.
+func (h *Handle) withStmt(ctx context.Context, query string, args []interface{}, fn func(ctx context.Context, stmt *sqlx.Stmt) error) error {
+	if err := h.enter(); err != nil {
+		return err
+	}
+	defer h.leave()
+
+	return h.retry(ctx, query, func() error {
+		return h.stmtAttempt(ctx, query, args, fn)
+	})
+}
+
+func (h *Handle) stmtAttempt(ctx context.Context, query string, args []interface{}, fn func(ctx context.Context, stmt *sqlx.Stmt) error) error {
+	return h.intercept(ctx, query, args, func(ctx context.Context) (err error) {
+		done, err := h.guard(ctx)
+		if err != nil {
+			return
+		}
+		defer func() {
+			done(err)
+		}()
+
+		n := h.route(ctx, query)
+		stmt, release, err := n.acquireStmt(ctx, query, nil)
+		if err != nil {
+			return err
+		}
+		err = fn(ctx, stmt)
+		release()
+		if !isStmtInvalid(n.db.DriverName(), err) {
+			return err
+		}
+
+		n.stmtSet.remove(query, stmt)
+		if stmt, release, err = n.acquireStmt(ctx, query, nil); err != nil {
+			return err
+		}
+		defer release()
+		return fn(ctx, stmt)
+	})
+}
+
+// withNamedStmt 取得 query 对应的 NamedStmt 并执行 fn, Hook, 重试和失效处理同 withStmt.
+func (h *Handle) withNamedStmt(ctx context.Context, query string, arg interface{}, fn func(ctx context.Context, stmt *sqlx.NamedStmt) error) error {
+	if err := h.enter(); err != nil {
+		return err
+	}
+	defer h.leave()
+
+	return h.retry(ctx, query, func() error {
+		return h.namedStmtAttempt(ctx, query, arg, fn)
+	})
+}
+
+func (h *Handle) namedStmtAttempt(ctx context.Context, query string, arg interface{}, fn func(ctx context.Context, stmt *sqlx.NamedStmt) error) error {
+	return h.intercept(ctx, query, []interface{}{arg}, func(ctx context.Context) (err error) {
+		done, err := h.guard(ctx)
+		if err != nil {
+			return
+		}
+		defer func() {
+			done(err)
+		}()
+
+		n := h.route(ctx, query)
+		stmt, release, err := n.acquireNamedStmt(ctx, query, nil)
+		if err != nil {
+			return err
+		}
+		err = fn(ctx, stmt)
+		release()
+		if !isStmtInvalid(n.db.DriverName(), err) {
+			return err
+		}
+
+		n.namedStmtSet.remove(query, stmt)
+		if stmt, release, err = n.acquireNamedStmt(ctx, query, nil); err != nil {
+			return err
+		}
+		defer release()
+		return fn(ctx, stmt)
+	})
+}
+
+func ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return defaultHandle.ExecContext(ctx, query, args...)
+}
+
+func QueryContext(ctx context.Context, query string, args ...interface{}) (*sqlx.Rows, error) {
+	return defaultHandle.QueryContext(ctx, query, args...)
+}
+
+func GetContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	return defaultHandle.GetContext(ctx, dest, query, args...)
+}
+
+func SelectContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	return defaultHandle.SelectContext(ctx, dest, query, args...)
+}
+
+func NamedExecContext(ctx context.Context, query string, arg interface{}) (sql.Result, error) {
+	return defaultHandle.NamedExecContext(ctx, query, arg)
+}
+
+func NamedQueryContext(ctx context.Context, query string, arg interface{}) (*sqlx.Rows, error) {
+	return defaultHandle.NamedQueryContext(ctx, query, arg)
+}
+
+func NamedGetContext(ctx context.Context, dest interface{}, query string, arg interface{}) error {
+	return defaultHandle.NamedGetContext(ctx, dest, query, arg)
+}
+
+func NamedSelectContext(ctx context.Context, dest interface{}, query string, arg interface{}) error {
+	return defaultHandle.NamedSelectContext(ctx, dest, query, arg)
+}
@@ -0,0 +1,181 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// errTransient 是测试中注入的可以重试的错误.
+var errTransient = errors.New("fake: transient error")
+
+// registeredFake 是注册为 "fakedb" 的驱动, 用于需要驱动名的测试, 比如 SchemaOpener.
+var registeredFake = &fakeDriver{}
+
+func init() {
+	sql.Register("fakedb", registeredFake)
+	RegisterRetryable(func(err error) bool {
+		return errors.Is(err, errTransient)
+	})
+}
+
+// fakeDriver 是测试用的 database/sql/driver 实现, 记录执行的操作, 可以注入错误.
+// 语句总是成功, Query 返回空的结果.
+type fakeDriver struct {
+	mutex sync.Mutex
+	ops   []string // 比如 "prepare SELECT 1", "exec SELECT 1", "close SELECT 1", "begin", "commit"
+
+	// fail 不为 nil 时在每个操作之前调用, 返回的错误作为操作的结果.
+	fail func(op, query string) error
+
+	// noRows 为 true 时 Exec 报告没有影响任何行.
+	noRows bool
+
+	// pingDelay 是 Ping 的耗时, 用于测试超时.
+	pingDelay time.Duration
+}
+
+// newFakeDB 返回使用 fakeDriver 的 sqlx.DB, 测试结束时关闭; 驱动名是 mysql, 占位符是 ?.
+func newFakeDB(t *testing.T) (*sqlx.DB, *fakeDriver) {
+	d := &fakeDriver{}
+	sqlDB := sql.OpenDB(d)
+	t.Cleanup(func() {
+		sqlDB.Close()
+	})
+	return sqlx.NewDb(sqlDB, "mysql"), d
+}
+
+func (d *fakeDriver) record(op, query string) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.ops = append(d.ops, strings.TrimSpace(op+" "+query))
+	if d.fail != nil {
+		return d.fail(op, query)
+	}
+	return nil
+}
+
+func (d *fakeDriver) setFail(fail func(op, query string) error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.fail = fail
+}
+
+// count 返回执行过的操作 op 的次数, op 的格式同 fakeDriver.ops.
+func (d *fakeDriver) count(op string) int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	n := 0
+	for _, o := range d.ops {
+		if o == op {
+			n++
+		}
+	}
+	return n
+}
+
+func (d *fakeDriver) Connect(ctx context.Context) (driver.Conn, error) {
+	return &fakeConn{d: d}, nil
+}
+
+func (d *fakeDriver) Driver() driver.Driver {
+	return d
+}
+
+func (d *fakeDriver) Open(name string) (driver.Conn, error) {
+	return &fakeConn{d: d}, nil
+}
+
+type fakeConn struct {
+	d *fakeDriver
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	if err := c.d.record("prepare", query); err != nil {
+		return nil, err
+	}
+	return &fakeDriverStmt{d: c.d, query: query}, nil
+}
+
+func (c *fakeConn) Ping(ctx context.Context) error {
+	if err := c.d.record("ping", ""); err != nil {
+		return err
+	}
+	c.d.mutex.Lock()
+	delay := c.d.pingDelay
+	c.d.mutex.Unlock()
+
+	select {
+	case <-time.After(delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	if err := c.d.record("begin", ""); err != nil {
+		return nil, err
+	}
+	return fakeTx{c.d}, nil
+}
+
+type fakeTx struct {
+	d *fakeDriver
+}
+
+func (tx fakeTx) Commit() error   { return tx.d.record("commit", "") }
+func (tx fakeTx) Rollback() error { return tx.d.record("rollback", "") }
+
+type fakeDriverStmt struct {
+	d     *fakeDriver
+	query string
+}
+
+func (s *fakeDriverStmt) Close() error {
+	s.d.record("close", s.query)
+	return nil
+}
+
+func (s *fakeDriverStmt) NumInput() int {
+	return -1
+}
+
+func (s *fakeDriverStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if err := s.d.record("exec", s.query); err != nil {
+		return nil, err
+	}
+	s.d.mutex.Lock()
+	defer s.d.mutex.Unlock()
+	if s.d.noRows {
+		return driver.RowsAffected(0), nil
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (s *fakeDriverStmt) Query(args []driver.Value) (driver.Rows, error) {
+	if err := s.d.record("query", s.query); err != nil {
+		return nil, err
+	}
+	return fakeRows{}, nil
+}
+
+type fakeRows struct{}
+
+func (fakeRows) Columns() []string              { return nil }
+func (fakeRows) Close() error                   { return nil }
+func (fakeRows) Next(dest []driver.Value) error { return io.EOF }
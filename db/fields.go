@@ -0,0 +1,244 @@
+package db
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aiyi/go/utils"
+)
+
+// fieldInfo 是结构体字段和数据库列的对应关系.
+type fieldInfo struct {
+	name    string            // Go 字段名
+	column  string            // 列名
+	index   []int             // 用于 fieldByIndex, 嵌入的结构体中的字段有多级
+	options map[string]string // db tag 中列名之后的选项, 比如 db:"name,opt1,opt2:value"
+
+	autoCreateTime bool   // 插入时自动填写时间, db:"created_at,autoCreateTime"
+	autoUpdateTime bool   // 插入和更新时自动填写时间, db:"updated_at,autoUpdateTime:milli"
+	timeUnit       string // 自动填写的时间的单位, 见 timestamps.value
+}
+
+func (f *fieldInfo) hasOption(name string) bool {
+	_, ok := f.options[name]
+	return ok
+}
+
+// structInfo 是一个结构体类型所有映射到列的字段, 按照字段定义的顺序排列.
+type structInfo struct {
+	fields []*fieldInfo
+	err    error // tag 中的错误, 使用这个类型生成语句时返回
+}
+
+var (
+	structInfosRWMutex sync.RWMutex
+	structInfos        = make(map[reflect.Type]*structInfo)
+)
+
+// getStructInfo 返回结构体类型 t 的字段信息, 结果按照类型缓存.
+func getStructInfo(t reflect.Type) *structInfo {
+	structInfosRWMutex.RLock()
+	info := structInfos[t]
+	structInfosRWMutex.RUnlock()
+	if info != nil {
+		return info
+	}
+
+	info = parseStructInfo(t)
+
+	structInfosRWMutex.Lock()
+	structInfos[t] = info
+	structInfosRWMutex.Unlock()
+	return info
+}
+
+func parseStructInfo(t reflect.Type) *structInfo {
+	info := &structInfo{}
+	parseFields(info, t, nil, "", map[reflect.Type]bool{t: true})
+
+	// 同名的列只保留层次最浅的, 同 Go 的字段提升规则; 同一层次的保留第一个
+	depths := make(map[string]int)
+	for _, f := range info.fields {
+		if d, ok := depths[f.column]; !ok || len(f.index) < d {
+			depths[f.column] = len(f.index)
+		}
+	}
+	fields := info.fields[:0]
+	for _, f := range info.fields {
+		if depths[f.column] == len(f.index) {
+			fields = append(fields, f)
+			depths[f.column] = -1
+		}
+	}
+	info.fields = fields
+	return info
+}
+
+// parseFields 把结构体类型 t 的字段加入 info, index 和 prefix 是 t 在最外层结构体中的位置和列名前缀.
+// 没有列名的匿名嵌入结构体和带 prefix tag 的结构体字段(`prefix:"home_"`)递归展开,
+// 其他结构体字段(比如 time.Time)作为一列. visiting 用于避免递归嵌入自身.
+func parseFields(info *structInfo, t reflect.Type, index []int, prefix string, visiting map[reflect.Type]bool) {
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		fieldIndex := append(append([]int{}, index...), i)
+
+		ft := sf.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		_, hasPrefix := sf.Tag.Lookup("prefix")
+		if ft.Kind() == reflect.Struct && (sf.Anonymous && !hasColumnName(sf) || hasPrefix) {
+			if sf.Tag.Get("db") == "-" || visiting[ft] {
+				continue
+			}
+			// 未导出的匿名结构体的导出字段仍然可以访问, 同 encoding/json
+			if sf.PkgPath != "" && !sf.Anonymous {
+				continue
+			}
+			visiting[ft] = true
+			parseFields(info, ft, fieldIndex, prefix+sf.Tag.Get("prefix"), visiting)
+			delete(visiting, ft)
+			continue
+		}
+
+		if sf.PkgPath != "" {
+			continue
+		}
+
+		column, options := columnName(sf)
+		if column == "" {
+			continue
+		}
+		f := &fieldInfo{
+			name:    sf.Name,
+			column:  prefix + column,
+			index:   fieldIndex,
+			options: options,
+		}
+		if err := f.parseTimeOptions(sf.Type); err != nil && info.err == nil {
+			info.err = fmt.Errorf("db: %s.%s: %v", t.Name(), sf.Name, err)
+		}
+		info.fields = append(info.fields, f)
+	}
+}
+
+// hasColumnName 判断字段的 db tag 或者 json tag 是否指定了列名.
+func hasColumnName(sf reflect.StructField) bool {
+	for _, key := range []string{"db", "json"} {
+		name := sf.Tag.Get(key)
+		if i := strings.IndexByte(name, ','); i >= 0 {
+			name = name[:i]
+		}
+		if name != "" && name != "-" {
+			return true
+		}
+	}
+	return false
+}
+
+// structValue 返回 v 指向的结构体, v 是 nil, nil 指针或者不是结构体时返回错误.
+func structValue(v interface{}) (reflect.Value, error) {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return reflect.Value{}, fmt.Errorf("db: nil %T", v)
+		}
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return reflect.Value{}, fmt.Errorf("db: %T is not a struct", v)
+	}
+	return rv, nil
+}
+
+// fieldByIndex 同 reflect.Value.FieldByIndex, 但是经过的嵌入结构体指针为 nil 时返回无效的 Value 而不是 panic.
+func fieldByIndex(v reflect.Value, index []int) reflect.Value {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return reflect.Value{}
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v
+}
+
+// parseTimeOptions 解析 autoCreateTime 和 autoUpdateTime 选项, 单位可以是 unix, milli, nano 和 time;
+// 没有指定单位时 time.Time 类型的字段使用 time, 其他使用 unix.
+func (f *fieldInfo) parseTimeOptions(t reflect.Type) error {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == reflect.TypeOf(time.Time{}) {
+		f.timeUnit = "time"
+	} else {
+		f.timeUnit = "unix"
+	}
+
+	for _, name := range []string{"autoCreateTime", "autoUpdateTime"} {
+		unit, ok := f.options[name]
+		if !ok {
+			continue
+		}
+		if name == "autoCreateTime" {
+			f.autoCreateTime = true
+		} else {
+			f.autoUpdateTime = true
+		}
+
+		switch unit {
+		case "":
+		case "unix", "milli", "nano", "time":
+			f.timeUnit = unit
+		default:
+			return fmt.Errorf("unknown time unit %q", unit)
+		}
+	}
+	return nil
+}
+
+// columnName 返回字段对应的列名和 db tag 中的选项, 不映射到列时返回空字符串.
+// 列名依次取 db tag 中的名字, json tag 中的名字和 utils.ToFieldName(字段名);
+// db tag 为 "-", 或者没有 db tag 而 json tag 为 "-" 的字段不映射到列.
+func columnName(sf reflect.StructField) (column string, options map[string]string) {
+	tag, hasTag := sf.Tag.Lookup("db")
+	if tag == "-" {
+		return "", nil
+	}
+	if hasTag {
+		parts := strings.Split(tag, ",")
+		column = strings.TrimSpace(parts[0])
+		for _, opt := range parts[1:] {
+			if opt = strings.TrimSpace(opt); opt == "" {
+				continue
+			}
+			if options == nil {
+				options = make(map[string]string)
+			}
+			if i := strings.IndexByte(opt, ':'); i >= 0 {
+				options[opt[:i]] = opt[i+1:]
+			} else {
+				options[opt] = ""
+			}
+		}
+	}
+
+	if column == "" {
+		jsonName := sf.Tag.Get("json")
+		if jsonName == "-" && !hasTag {
+			return "", nil
+		}
+		if i := strings.IndexByte(jsonName, ','); i >= 0 {
+			jsonName = jsonName[:i]
+		}
+		if column = jsonName; column == "" || column == "-" {
+			column = utils.ToFieldName(sf.Name)
+		}
+	}
+	return column, options
+}
@@ -0,0 +1,141 @@
+package db
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func columns(t *testing.T, v interface{}) []string {
+	t.Helper()
+	info := getStructInfo(reflect.TypeOf(v))
+	if info.err != nil {
+		t.Fatal(info.err)
+	}
+	var cols []string
+	for _, f := range info.fields {
+		cols = append(cols, f.column)
+	}
+	return cols
+}
+
+func TestColumnNames(t *testing.T) {
+	type row struct {
+		ID       *int64  `db:"id,autoIncrement" json:"uid"`
+		UserName *string `json:"user"`
+		NickName *string
+		Email    *string `db:",unique" json:"mail"`
+		Secret   *string `db:"-" json:"secret"`
+		Hidden   *string `json:"-"`
+		Shown    *string `db:"shown" json:"-"`
+		internal *string
+	}
+	want := []string{"id", "user", "nick_name", "mail", "shown"}
+	if cols := columns(t, row{}); !reflect.DeepEqual(cols, want) {
+		t.Errorf("columns = %q, want %q", cols, want)
+	}
+
+	info := getStructInfo(reflect.TypeOf(row{}))
+	if !info.fields[0].hasOption("autoIncrement") || !info.fields[3].hasOption("unique") {
+		t.Error("tag options are not parsed")
+	}
+}
+
+func TestUpdateSetArgs(t *testing.T) {
+	type patch struct {
+		Name  *string  `db:"name"`
+		Age   *int     `db:"age"`
+		Tags  []string `db:"tags"`
+		Score int      `db:"score"` // 非指针和切片的字段不更新
+		Note  *string  `json:"note"`
+	}
+	name, note := "bob", "n"
+	var s bytes.Buffer
+	var args []interface{}
+	set := updateSetArgs(&s, &patch{Name: &name, Tags: []string{"a"}, Score: 1, Note: &note}, &args)
+	if set.err != nil {
+		t.Fatal(set.err)
+	}
+	if s.String() != "name=?, tags=?, note=? " || set.fields != 3 {
+		t.Errorf("set = %q, fields = %d", s.String(), set.fields)
+	}
+	if !reflect.DeepEqual(args, []interface{}{"bob", []string{"a"}, "n"}) {
+		t.Errorf("args = %v", args)
+	}
+}
+
+type auditFields struct {
+	Name     *string `db:"name"` // 被外层的 name 覆盖
+	Modified *int64  `db:"modified"`
+	Version  *int64  `db:"version,version"`
+}
+
+type addressFields struct {
+	City *string `db:"city"`
+}
+
+type nestedPatch struct {
+	*auditFields
+	addressFields
+	Name  *string       `db:"name"`
+	Home  addressFields `prefix:"home_"`
+	Self  *nestedPatch  `prefix:"self_"` // 递归嵌入自身的字段被忽略
+	Owner *struct {
+		Name *string `db:"name"`
+	} `prefix:"owner_"`
+}
+
+func TestNestedColumns(t *testing.T) {
+	want := []string{"modified", "version", "city", "name", "home_city", "owner_name"}
+	if cols := columns(t, nestedPatch{}); !reflect.DeepEqual(cols, want) {
+		t.Errorf("columns = %q, want %q", cols, want)
+	}
+}
+
+func TestUpdateSetArgsNested(t *testing.T) {
+	city, name := "c", "n"
+	var s bytes.Buffer
+	var args []interface{}
+
+	// 为 nil 的嵌入指针的字段按零值处理: 修改时间和版本仍然写入, 不检查版本
+	set := updateSetArgs(&s, &nestedPatch{addressFields: addressFields{City: &city}, Name: &name, Home: addressFields{City: &city}}, &args)
+	if set.err != nil {
+		t.Fatal(set.err)
+	}
+	if s.String() != "modified=?, version=version+1, city=?, name=?, home_city=? " || set.fields != 5 || set.version != nil {
+		t.Errorf("set = %q, fields = %d, version = %v", s.String(), set.fields, set.version)
+	}
+
+	version := int64(2)
+	query, args, err := BuildUpdate("t", &nestedPatch{auditFields: &auditFields{Version: &version}, Name: &name}, new(Filter).Where("id = ?", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "UPDATE t SET modified=?, version=version+1, name=? WHERE ((id = ?)) AND version = ?"; query != want {
+		t.Errorf("query = %q, want %q", query, want)
+	}
+	if len(args) != 4 || args[3] != int64(2) {
+		t.Errorf("args = %v", args)
+	}
+}
+
+func TestUpdateSetArgsBadInput(t *testing.T) {
+	var s bytes.Buffer
+	var args []interface{}
+	for _, para := range []interface{}{nil, (*nestedPatch)(nil), 3} {
+		if n := SqlUpdateSetArgs(&s, para, &args); n != 0 || s.Len() != 0 {
+			t.Errorf("SqlUpdateSetArgs(%#v) = %d, wrote %q", para, n, s.String())
+		}
+		if _, err := UpdateSetArgs(&s, para, &args); err == nil || s.Len() != 0 {
+			t.Errorf("UpdateSetArgs(%#v): err = %v, wrote %q", para, err, s.String())
+		}
+	}
+	if len(args) != 0 {
+		t.Errorf("args = %v", args)
+	}
+
+	name := "n"
+	if n, err := UpdateSetArgs(&s, &nestedPatch{Name: &name}, &args); err != nil || n != 3 {
+		t.Errorf("UpdateSetArgs = %d, %v", n, err)
+	}
+}
@@ -0,0 +1,265 @@
+package db
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// DefaultName 是默认数据库句柄的名字, 包级别的 SetDB, GetStmt 等函数都作用于这个句柄.
+const DefaultName = "default"
+
+// Handle 是一个命名的数据库句柄, 拥有自己的 sqlx.DB, Stmt 缓存和清理 ticker.
+// 同一个进程需要访问多个数据库时, 每个数据库使用一个 Handle, 见 Use.
+//
+// Handle 可以有若干从库, 见 SetReplicas; 只读的 SELECT 在从库上创建 Stmt, 其他语句在主库上创建.
+type Handle struct {
+	name string
+
+	nodesRWMutex sync.RWMutex // 保护主库, 从库和下面的设置
+	primary      *node
+	replicas     []*node
+	balance      Balance
+	next         uint32 // RoundRobin 的计数器
+	cacheOpts    CacheOptions
+
+	cleanerMutex sync.Mutex
+	cleaner      *Cleaner
+
+	hooksRWMutex sync.RWMutex
+	hooks        []Hook
+
+	retryRWMutex sync.RWMutex
+	retryPolicy  *RetryPolicy
+
+	guardRWMutex sync.RWMutex
+	breaker      *Breaker
+	limiter      *limiter
+
+	drainMutex sync.Mutex
+	inflight   int           // 正在进行的数据库操作数量, 见 enter
+	drained    chan struct{} // Shutdown 时创建, 正在进行的操作都结束时关闭
+}
+
+var (
+	handlesRWMutex sync.RWMutex
+	handles        = make(map[string]*Handle) // map[name]*Handle
+
+	defaultHandle = Use(DefaultName)
+)
+
+func newHandle(name string) *Handle {
+	return &Handle{
+		name:      name,
+		primary:   newNode("primary", nil, DefaultCacheOptions),
+		cacheOpts: DefaultCacheOptions,
+	}
+}
+
+// Use 返回名字为 name 的数据库句柄, 如果不存在则创建一个还没有设置 sqlx.DB 的句柄.
+//
+//	db.Use("orders").SetDB(ordersDB)
+//	stmt, err := db.Use("orders").GetStmt(query)
+func Use(name string) *Handle {
+	handlesRWMutex.RLock()
+	h := handles[name]
+	handlesRWMutex.RUnlock()
+
+	if h != nil {
+		return h
+	}
+
+	handlesRWMutex.Lock()
+	defer handlesRWMutex.Unlock()
+
+	if h = handles[name]; h != nil {
+		return h
+	}
+	h = newHandle(name)
+	handles[name] = h
+	return h
+}
+
+// Handles 返回所有已经创建的数据库句柄, 按名字排序.
+func Handles() []*Handle {
+	handlesRWMutex.RLock()
+	defer handlesRWMutex.RUnlock()
+
+	hs := make([]*Handle, 0, len(handles))
+	for _, h := range handles {
+		hs = append(hs, h)
+	}
+	sort.Slice(hs, func(i, j int) bool { return hs[i].name < hs[j].name })
+	return hs
+}
+
+func (h *Handle) Name() string {
+	return h.name
+}
+
+// SetDB 设置主库, 替换掉之前设置的主库并关闭它缓存的 Stmt; 不会关闭之前的主库连接.
+// 被 Shutdown 关闭的句柄可以通过 SetDB 重新使用.
+func (h *Handle) SetDB(d *sqlx.DB) {
+	h.nodesRWMutex.Lock()
+	old := h.primary
+	h.primary = newNode("primary", d, h.cacheOpts)
+	h.nodesRWMutex.Unlock()
+
+	old.close()
+	h.reopen()
+}
+
+// GetDB 返回主库.
+func (h *Handle) GetDB() *sqlx.DB {
+	return h.primaryNode().db
+}
+
+// SetReplicas 设置从库, 替换掉之前设置的从库并关闭它们缓存的 Stmt; 不会关闭之前的从库连接.
+// 没有从库时所有语句都在主库上执行.
+func (h *Handle) SetReplicas(replicas ...*sqlx.DB) {
+	h.nodesRWMutex.Lock()
+	defer h.nodesRWMutex.Unlock()
+
+	for _, n := range h.replicas {
+		n.close()
+	}
+	h.replicas = make([]*node, 0, len(replicas))
+	for i, d := range replicas {
+		h.replicas = append(h.replicas, newNode("replica"+strconv.Itoa(i), d, h.cacheOpts))
+	}
+}
+
+// GetReplicas 返回所有从库.
+func (h *Handle) GetReplicas() []*sqlx.DB {
+	h.nodesRWMutex.RLock()
+	defer h.nodesRWMutex.RUnlock()
+
+	replicas := make([]*sqlx.DB, len(h.replicas))
+	for i, n := range h.replicas {
+		replicas[i] = n.db
+	}
+	return replicas
+}
+
+// SetBalance 设置在多个从库之间选择的策略, 默认是 RoundRobin.
+func (h *Handle) SetBalance(b Balance) {
+	h.nodesRWMutex.Lock()
+	defer h.nodesRWMutex.Unlock()
+	h.balance = b
+}
+
+// CloseDB 停止 Cleaner, 关闭主库和所有从库的连接, 释放资源; 没有设置数据库时只停止 Cleaner.
+func (h *Handle) CloseDB() (err error) {
+	h.StopCleaner()
+	for _, n := range h.nodes() {
+		if n.db == nil {
+			continue // 还没有调用 SetDB
+		}
+		if e := n.db.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return
+}
+
+// SetCacheOptions 设置 Stmt 缓存的容量和淘汰策略, 作用于主库和从库上 GetStmt 和 GetNamedStmt 的缓存.
+// 缩小容量会立即淘汰多出来的 Stmt.
+func (h *Handle) SetCacheOptions(opts CacheOptions) {
+	h.nodesRWMutex.Lock()
+	h.cacheOpts = opts
+	h.nodesRWMutex.Unlock()
+
+	for _, n := range h.nodes() {
+		n.setCacheOptions(opts)
+	}
+}
+
+// CloseAllStmt 关闭主库和从库上所有缓存的 Stmt, 释放资源.
+func (h *Handle) CloseAllStmt() {
+	for _, n := range h.nodes() {
+		n.closeAllStmt()
+	}
+}
+
+// GetStmt 返回 query 对应的 Stmt, 只读的 SELECT 在从库上创建, 见 GetStmtContext.
+func (h *Handle) GetStmt(query string) (stmt *sqlx.Stmt, err error) {
+	return h.GetStmtContext(context.Background(), query)
+}
+
+// GetNamedStmt 返回 query 对应的 NamedStmt, 只读的 SELECT 在从库上创建, 见 GetNamedStmtContext.
+func (h *Handle) GetNamedStmt(query string) (stmt *sqlx.NamedStmt, err error) {
+	return h.GetNamedStmtContext(context.Background(), query)
+}
+
+// GetStmtContext 返回 query 对应的 Stmt.
+// 只读的 SELECT 在从库上创建, 除非 ctx 被 WithPrimary 强制使用主库; 其他语句在主库上创建.
+//
+// 创建 Stmt 时使用 ctx, ctx 结束时返回 ctx.Err(); 同一个 query 同时只会创建一次, 其他调用者等待结果.
+// 只有真正创建 Stmt 时经过熔断器和并发限制, 缓存命中不计入, 见 SetBreaker.
+func (h *Handle) GetStmtContext(ctx context.Context, query string) (stmt *sqlx.Stmt, err error) {
+	if err = h.enter(); err != nil {
+		return
+	}
+	defer h.leave()
+
+	return h.route(ctx, query).getStmt(ctx, query, h.guard)
+}
+
+// GetNamedStmtContext 返回 query 对应的 NamedStmt, 路由规则同 GetStmtContext.
+func (h *Handle) GetNamedStmtContext(ctx context.Context, query string) (stmt *sqlx.NamedStmt, err error) {
+	if err = h.enter(); err != nil {
+		return
+	}
+	defer h.leave()
+
+	return h.route(ctx, query).getNamedStmt(ctx, query, h.guard)
+}
+
+// route 选择执行 query 的 node.
+func (h *Handle) route(ctx context.Context, query string) *node {
+	h.nodesRWMutex.RLock()
+	defer h.nodesRWMutex.RUnlock()
+
+	if IsPrimary(ctx) || !isReadQuery(h.primary.driverName(), query) {
+		return h.primary
+	}
+
+	switch len(h.replicas) {
+	case 0:
+		return h.primary
+	case 1:
+		return h.replicas[0]
+	}
+
+	if h.balance == LeastInFlight {
+		picked, min := h.replicas[0], h.replicas[0].inUse()
+		for _, n := range h.replicas[1:] {
+			if inUse := n.inUse(); inUse < min {
+				picked, min = n, inUse
+			}
+		}
+		return picked
+	}
+	i := atomic.AddUint32(&h.next, 1)
+	return h.replicas[i%uint32(len(h.replicas))]
+}
+
+func (h *Handle) primaryNode() *node {
+	h.nodesRWMutex.RLock()
+	defer h.nodesRWMutex.RUnlock()
+	return h.primary
+}
+
+// nodes 返回主库和所有从库.
+func (h *Handle) nodes() []*node {
+	h.nodesRWMutex.RLock()
+	defer h.nodesRWMutex.RUnlock()
+
+	nodes := make([]*node, 0, len(h.replicas)+1)
+	nodes = append(nodes, h.primary)
+	return append(nodes, h.replicas...)
+}
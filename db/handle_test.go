@@ -0,0 +1,87 @@
+package db
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+func TestSetDBPurgesStmts(t *testing.T) {
+	db1, d1 := newFakeDB(t)
+	db2, d2 := newFakeDB(t)
+	h := newHandle("test")
+	h.SetCacheOptions(CacheOptions{})
+	h.SetDB(db1)
+
+	if _, err := h.GetStmt("UPDATE t SET a=1"); err != nil {
+		t.Fatal(err)
+	}
+	h.SetDB(db2)
+	if d1.count("close UPDATE t SET a=1") != 1 {
+		t.Error("stmt prepared on the previous DB is not closed")
+	}
+
+	if _, err := h.GetStmt("UPDATE t SET a=1"); err != nil {
+		t.Fatal(err)
+	}
+	if d2.count("prepare UPDATE t SET a=1") != 1 {
+		t.Error("stmt is not prepared on the new DB")
+	}
+}
+
+func TestSetDBConcurrent(t *testing.T) {
+	db1, _ := newFakeDB(t)
+	db2, _ := newFakeDB(t)
+	h := newHandle("test")
+	h.SetDB(db1)
+
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if _, err := h.ExecContext(ctx, "UPDATE t SET a=1"); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 100; i++ {
+		if i%2 == 0 {
+			h.SetDB(db2)
+		} else {
+			h.SetDB(db1)
+		}
+	}
+	wg.Wait()
+}
+
+func TestSetDBRacingAcquire(t *testing.T) {
+	db1, d1 := newFakeDB(t)
+	db2, _ := newFakeDB(t)
+	h := newHandle("test")
+	h.SetCacheOptions(CacheOptions{})
+	h.SetDB(db1)
+	ctx := context.Background()
+
+	// 调用者在 SetDB 之前选中了旧的主库, 之后才创建 Stmt
+	old := h.route(ctx, "UPDATE t SET a=1")
+	h.SetDB(db2)
+	_, release, err := old.acquireStmt(ctx, "UPDATE t SET a=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d1.count("close UPDATE t SET a=1") != 0 {
+		t.Fatal("stmt is closed while still acquired")
+	}
+	release()
+	if d1.count("prepare UPDATE t SET a=1") != 1 || d1.count("close UPDATE t SET a=1") != 1 {
+		t.Errorf("stmt on the replaced DB is not closed after release: ops = %q", d1.ops)
+	}
+	if old.stmtSet.len() != 0 {
+		t.Error("stmt is cached in the replaced node")
+	}
+}
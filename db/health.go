@@ -0,0 +1,140 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// NodeHealth 是主库或者一个从库的健康状况.
+type NodeHealth struct {
+	Name               string      `json:"name"`
+	OK                 bool        `json:"ok"`
+	Error              string      `json:"error,omitempty"`
+	Latency            Duration    `json:"latency"` // ping 的耗时
+	Pool               sql.DBStats `json:"pool"`
+	StmtCacheSize      int         `json:"stmt_cache_size"`
+	NamedStmtCacheSize int         `json:"named_stmt_cache_size"`
+}
+
+// HandleHealth 是一个句柄的健康状况, 主库和所有从库都 ping 成功时 OK 为 true.
+type HandleHealth struct {
+	Name           string       `json:"name"`
+	OK             bool         `json:"ok"`
+	Nodes          []NodeHealth `json:"nodes"`
+	CleanerRunning bool         `json:"cleaner_running"`
+	Breaker        string       `json:"breaker,omitempty"` // 熔断器的状态, 没有设置熔断器时为空
+}
+
+// HealthReport 是所有设置了数据库的句柄的健康状况, 所有句柄都 OK 时 OK 为 true.
+type HealthReport struct {
+	OK      bool           `json:"ok"`
+	Handles []HandleHealth `json:"handles"`
+}
+
+func (n *node) health(ctx context.Context) NodeHealth {
+	if n.db == nil {
+		return NodeHealth{Name: n.name, Error: "no database"}
+	}
+	start := time.Now()
+	err := n.db.PingContext(ctx)
+	health := NodeHealth{
+		Name:               n.name,
+		OK:                 err == nil,
+		Latency:            Duration(time.Since(start)),
+		Pool:               n.db.Stats(),
+		StmtCacheSize:      n.stmtSet.len(),
+		NamedStmtCacheSize: n.namedStmtSet.len(),
+	}
+	if err != nil {
+		health.Error = err.Error()
+	}
+	return health
+}
+
+// Health 并发地 ping 主库和所有从库, 返回健康状况.
+func (h *Handle) Health(ctx context.Context) HandleHealth {
+	nodes := h.nodes()
+	health := HandleHealth{
+		Name:  h.name,
+		OK:    true,
+		Nodes: make([]NodeHealth, len(nodes)),
+	}
+
+	var wg sync.WaitGroup
+	for i, n := range nodes {
+		wg.Add(1)
+		go func(i int, n *node) {
+			defer wg.Done()
+			health.Nodes[i] = n.health(ctx)
+		}(i, n)
+	}
+	wg.Wait()
+
+	for _, n := range health.Nodes {
+		health.OK = health.OK && n.OK
+	}
+	if c := h.Cleaner(); c != nil {
+		health.CleanerRunning = c.Running()
+	}
+	if b := h.Breaker(); b != nil {
+		health.Breaker = b.State().String()
+	}
+	return health
+}
+
+// Health 检查所有设置了数据库的句柄, 没有句柄设置数据库时 OK 为 false.
+func Health(ctx context.Context) HealthReport {
+	var hs []*Handle
+	for _, h := range Handles() {
+		if h.GetDB() != nil {
+			hs = append(hs, h)
+		}
+	}
+
+	report := HealthReport{
+		OK:      len(hs) > 0,
+		Handles: make([]HandleHealth, len(hs)),
+	}
+
+	var wg sync.WaitGroup
+	for i, h := range hs {
+		wg.Add(1)
+		go func(i int, h *Handle) {
+			defer wg.Done()
+			report.Handles[i] = h.Health(ctx)
+		}(i, h)
+	}
+	wg.Wait()
+
+	for _, h := range report.Handles {
+		report.OK = report.OK && h.OK
+	}
+	return report
+}
+
+// HealthHandler 返回以 JSON 输出 Health 结果的 http.Handler, 可以用于 k8s 的 readiness probe.
+// 健康时返回 200, 否则返回 503; timeout > 0 时作为 ping 的超时时间.
+func HealthHandler(timeout time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+
+		report := Health(ctx)
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		if report.OK {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(report)
+	})
+}
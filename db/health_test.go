@@ -0,0 +1,132 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// isolateHandles 让 Handles 在测试期间只包含 hs, 测试结束时恢复; 避免其他测试留下的句柄影响 Health.
+func isolateHandles(t *testing.T, hs ...*Handle) {
+	handlesRWMutex.Lock()
+	saved := handles
+	handles = make(map[string]*Handle, len(hs))
+	for _, h := range hs {
+		handles[h.name] = h
+	}
+	handlesRWMutex.Unlock()
+
+	t.Cleanup(func() {
+		handlesRWMutex.Lock()
+		handles = saved
+		handlesRWMutex.Unlock()
+	})
+}
+
+func TestHandleHealth(t *testing.T) {
+	d, _ := newFakeDB(t)
+	replica, _ := newFakeDB(t)
+	h := newHandle("test-health")
+	h.SetDB(d)
+	h.SetReplicas(replica)
+	h.SetBreaker(NewBreaker(BreakerOptions{}))
+	h.StartCleaner(CleanerOptions{Interval: time.Hour})
+	defer h.StopCleaner()
+
+	if _, err := h.GetStmt("UPDATE t SET a=1"); err != nil {
+		t.Fatal(err)
+	}
+	health := h.Health(context.Background())
+	if !health.OK || len(health.Nodes) != 2 || !health.CleanerRunning || health.Breaker != "closed" {
+		t.Fatalf("health = %+v", health)
+	}
+	if n := health.Nodes[0]; n.Name != "primary" || !n.OK || n.StmtCacheSize != 1 || n.Pool.OpenConnections != 1 {
+		t.Errorf("primary = %+v", n)
+	}
+	if n := health.Nodes[1]; n.Name != "replica0" || !n.OK || n.Error != "" {
+		t.Errorf("replica = %+v", n)
+	}
+
+	// 从库关闭之后句柄不健康
+	replica.Close()
+	health = h.Health(context.Background())
+	if health.OK || !health.Nodes[0].OK || health.Nodes[1].OK || health.Nodes[1].Error != "sql: database is closed" {
+		t.Errorf("health with a closed replica = %+v", health)
+	}
+}
+
+func TestHandleHealthNilReplica(t *testing.T) {
+	d, _ := newFakeDB(t)
+	h := newHandle("test-health-nil")
+	h.SetDB(d)
+	h.SetReplicas(nil)
+
+	health := h.Health(context.Background())
+	if health.OK || !health.Nodes[0].OK || health.Nodes[1].OK || health.Nodes[1].Error != "no database" {
+		t.Errorf("health with a nil replica = %+v", health)
+	}
+
+	// LeastInFlight 不会因为没有设置数据库的从库 panic, 也不会选中它
+	replica, _ := newFakeDB(t)
+	h.SetReplicas(nil, replica)
+	h.SetBalance(LeastInFlight)
+	if n := h.route(context.Background(), "SELECT 1"); n.db != replica {
+		t.Errorf("route picked %s", n.name)
+	}
+}
+
+func TestHealthHandler(t *testing.T) {
+	d, _ := newFakeDB(t)
+	h := newHandle("test-health-handler")
+	h.SetDB(d)
+	isolateHandles(t, h, newHandle("test-health-no-db"))
+
+	get := func(timeout time.Duration) (int, HealthReport) {
+		w := httptest.NewRecorder()
+		HealthHandler(timeout).ServeHTTP(w, httptest.NewRequest("GET", "/health", nil))
+		if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+			t.Errorf("Content-Type = %q", ct)
+		}
+		var report HealthReport
+		if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+			t.Fatalf("invalid JSON body %q: %v", w.Body.String(), err)
+		}
+		return w.Code, report
+	}
+
+	// 没有设置数据库的句柄不参与检查
+	code, report := get(0)
+	if code != http.StatusOK || !report.OK || len(report.Handles) != 1 || report.Handles[0].Name != "test-health-handler" {
+		t.Errorf("healthy: code = %d, report = %+v", code, report)
+	}
+
+	// 慢的从库在超时后报告错误, 不影响主库的结果
+	replica, fake := newFakeDB(t)
+	fake.pingDelay = time.Second
+	h.SetReplicas(replica)
+
+	start := time.Now()
+	code, report = get(50 * time.Millisecond)
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("timeout is not applied: took %v", elapsed)
+	}
+	if code != http.StatusServiceUnavailable || report.OK {
+		t.Fatalf("slow replica: code = %d, report = %+v", code, report)
+	}
+	nodes := report.Handles[0].Nodes
+	if !nodes[0].OK || nodes[1].OK || nodes[1].Error != context.DeadlineExceeded.Error() {
+		t.Errorf("nodes = %+v", nodes)
+	}
+}
+
+func TestHealthNoHandles(t *testing.T) {
+	isolateHandles(t, newHandle("test-health-empty"))
+
+	if report := Health(context.Background()); report.OK || len(report.Handles) != 0 {
+		t.Errorf("report without any database = %+v", report)
+	}
+}
@@ -0,0 +1,60 @@
+package db
+
+import (
+	"context"
+	"time"
+)
+
+// Hook 在 Handle 的 ExecContext, QueryContext, GetContext, SelectContext 等函数执行语句前后被调用,
+// 用于慢查询日志, 监控和链路追踪. 直接使用 GetStmt 返回的 Stmt 执行的语句不会经过 Hook.
+//
+// 对于 Named 系列函数, args 只有一个元素, 就是传入的 arg.
+type Hook interface {
+	// BeforeQuery 在执行语句之前调用, 返回的 context 用于执行语句并传给 AfterQuery,
+	// 可以在里面保存 trace span 等信息; 不需要时直接返回 ctx.
+	// 返回已经取消的 context 可以终止执行, 调用者和所有的 AfterQuery 得到 ctx.Err().
+	BeforeQuery(ctx context.Context, query string, args []interface{}) context.Context
+
+	// AfterQuery 在语句执行完成后调用, dur 包含创建 Stmt 的时间, err 是返回给调用者的错误.
+	AfterQuery(ctx context.Context, query string, args []interface{}, dur time.Duration, err error)
+}
+
+// AddHook 增加一个 Hook, BeforeQuery 按照增加的顺序调用, AfterQuery 按照相反的顺序调用.
+func (h *Handle) AddHook(hook Hook) {
+	h.hooksRWMutex.Lock()
+	defer h.hooksRWMutex.Unlock()
+
+	hooks := make([]Hook, len(h.hooks), len(h.hooks)+1)
+	copy(hooks, h.hooks)
+	h.hooks = append(hooks, hook)
+}
+
+func (h *Handle) getHooks() []Hook {
+	h.hooksRWMutex.RLock()
+	defer h.hooksRWMutex.RUnlock()
+	return h.hooks
+}
+
+// intercept 在 fn 前后调用所有的 Hook.
+func (h *Handle) intercept(ctx context.Context, query string, args []interface{}, fn func(ctx context.Context) error) error {
+	hooks := h.getHooks()
+	if len(hooks) == 0 {
+		return fn(ctx)
+	}
+
+	for _, hook := range hooks {
+		ctx = hook.BeforeQuery(ctx, query, args)
+	}
+	start := time.Now()
+	err := fn(ctx)
+	dur := time.Since(start)
+	for i := len(hooks) - 1; i >= 0; i-- {
+		hooks[i].AfterQuery(ctx, query, args, dur, err)
+	}
+	return err
+}
+
+// AddHook 为默认句柄增加一个 Hook.
+func AddHook(hook Hook) {
+	defaultHandle.AddHook(hook)
+}
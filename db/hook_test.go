@@ -0,0 +1,175 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+type hookKey string
+
+// recordHook 把 BeforeQuery 和 AfterQuery 的调用记录到 calls, 通过 context 检查前后是否配对.
+type recordHook struct {
+	name  string
+	mutex *sync.Mutex
+	calls *[]string
+
+	// cancel 为 true 时 BeforeQuery 返回已经取消的 context, 终止语句的执行.
+	cancel bool
+}
+
+func (hook *recordHook) BeforeQuery(ctx context.Context, query string, args []interface{}) context.Context {
+	hook.mutex.Lock()
+	*hook.calls = append(*hook.calls, fmt.Sprintf("before %s %s %v", hook.name, query, args))
+	hook.mutex.Unlock()
+
+	ctx = context.WithValue(ctx, hookKey(hook.name), query)
+	if hook.cancel {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		cancel()
+	}
+	return ctx
+}
+
+func (hook *recordHook) AfterQuery(ctx context.Context, query string, args []interface{}, dur time.Duration, err error) {
+	hook.mutex.Lock()
+	defer hook.mutex.Unlock()
+
+	if ctx.Value(hookKey(hook.name)) != query {
+		*hook.calls = append(*hook.calls, "after "+hook.name+" without the context of BeforeQuery")
+		return
+	}
+	if dur < 0 {
+		*hook.calls = append(*hook.calls, fmt.Sprintf("after %s negative duration %v", hook.name, dur))
+		return
+	}
+	*hook.calls = append(*hook.calls, fmt.Sprintf("after %s %s %v", hook.name, query, err))
+}
+
+func newHookHandle(t *testing.T, name string, cancel ...bool) (*Handle, *fakeDriver, *[]string) {
+	d, fake := newFakeDB(t)
+	h := newHandle(name)
+	h.SetDB(d)
+
+	calls := new([]string)
+	mutex := new(sync.Mutex)
+	for i, name := range []string{"a", "b", "c"} {
+		h.AddHook(&recordHook{name: name, mutex: mutex, calls: calls, cancel: i < len(cancel) && cancel[i]})
+	}
+	return h, fake, calls
+}
+
+func TestHookOrder(t *testing.T) {
+	h, fake, calls := newHookHandle(t, "test-hook-order")
+
+	if _, err := h.ExecContext(context.Background(), "UPDATE t SET a=?", 1); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"before a UPDATE t SET a=? [1]",
+		"before b UPDATE t SET a=? [1]",
+		"before c UPDATE t SET a=? [1]",
+		"after c UPDATE t SET a=? <nil>",
+		"after b UPDATE t SET a=? <nil>",
+		"after a UPDATE t SET a=? <nil>",
+	}
+	if !reflect.DeepEqual(*calls, want) {
+		t.Errorf("calls = %q, want %q", *calls, want)
+	}
+	if n := fake.count("exec UPDATE t SET a=?"); n != 1 {
+		t.Errorf("executed %d times, want 1", n)
+	}
+
+	// Named 系列函数的 args 是传入的 arg
+	*calls = nil
+	arg := map[string]interface{}{"a": 2}
+	if _, err := h.NamedExecContext(context.Background(), "UPDATE t SET a=:a", arg); err != nil {
+		t.Fatal(err)
+	}
+	if len(*calls) != 6 || (*calls)[0] != "before a UPDATE t SET a=:a [map[a:2]]" {
+		t.Errorf("calls = %q", *calls)
+	}
+}
+
+func TestHookError(t *testing.T) {
+	h, fake, calls := newHookHandle(t, "test-hook-error")
+
+	errExec := errors.New("fake: exec failed")
+	fake.setFail(func(op, query string) error {
+		if op == "exec" {
+			return errExec
+		}
+		return nil
+	})
+	if _, err := h.ExecContext(context.Background(), "DELETE FROM t"); err != errExec {
+		t.Fatalf("err = %v, want %v", err, errExec)
+	}
+	want := []string{
+		"before a DELETE FROM t []",
+		"before b DELETE FROM t []",
+		"before c DELETE FROM t []",
+		"after c DELETE FROM t fake: exec failed",
+		"after b DELETE FROM t fake: exec failed",
+		"after a DELETE FROM t fake: exec failed",
+	}
+	if !reflect.DeepEqual(*calls, want) {
+		t.Errorf("calls = %q, want %q", *calls, want)
+	}
+}
+
+func TestHookRetry(t *testing.T) {
+	h, fake, calls := newHookHandle(t, "test-hook-retry")
+	h.SetRetryPolicy(&RetryPolicy{MaxAttempts: 2})
+
+	failed := false
+	fake.setFail(func(op, query string) error {
+		if op == "query" && !failed {
+			failed = true
+			return errTransient
+		}
+		return nil
+	})
+	var ids []int
+	if err := h.SelectContext(context.Background(), &ids, "SELECT id FROM t"); err != nil {
+		t.Fatal(err)
+	}
+
+	// 每次重试都调用 Hook
+	if len(*calls) != 12 {
+		t.Fatalf("calls = %q, want 2 rounds", *calls)
+	}
+	if got, want := (*calls)[3], "after c SELECT id FROM t "+errTransient.Error(); got != want {
+		t.Errorf("calls[3] = %q, want %q", got, want)
+	}
+	if got, want := (*calls)[11], "after a SELECT id FROM t <nil>"; got != want {
+		t.Errorf("calls[11] = %q, want %q", got, want)
+	}
+}
+
+func TestHookAbort(t *testing.T) {
+	// 第二个 Hook 返回取消的 context, 语句不会执行, 所有的 AfterQuery 仍然被调用
+	h, fake, calls := newHookHandle(t, "test-hook-abort", false, true)
+
+	if _, err := h.ExecContext(context.Background(), "DELETE FROM t"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want %v", err, context.Canceled)
+	}
+	if n := fake.count("exec DELETE FROM t"); n != 0 {
+		t.Errorf("executed %d times after the hook aborted", n)
+	}
+	want := []string{
+		"before a DELETE FROM t []",
+		"before b DELETE FROM t []",
+		"before c DELETE FROM t []",
+		"after c DELETE FROM t context canceled",
+		"after b DELETE FROM t context canceled",
+		"after a DELETE FROM t context canceled",
+	}
+	if !reflect.DeepEqual(*calls, want) {
+		t.Errorf("calls = %q, want %q", *calls, want)
+	}
+}
@@ -0,0 +1,39 @@
+// Package driverutil 提供 db 和它的子包共用的 database/sql/driver 辅助函数.
+package driverutil
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+)
+
+// OpenConnector 返回连接 dsn 的 driver.Connector, driverName 是已经注册的驱动名.
+// 驱动实现了 driver.DriverContext 时使用它的 Connector, 否则每次连接调用 driver.Open.
+// 用于包装真实驱动的连接, 比如在新连接上执行初始化语句.
+func OpenConnector(driverName, dsn string) (driver.Connector, error) {
+	// database/sql 没有按名字查找驱动的函数, 通过一个不会建立连接的 sql.DB 取得
+	base, err := sql.Open(driverName, dsn)
+	if err != nil {
+		return nil, err
+	}
+	drv := base.Driver()
+	base.Close()
+
+	if dc, ok := drv.(driver.DriverContext); ok {
+		return dc.OpenConnector(dsn)
+	}
+	return dsnConnector{driver: drv, dsn: dsn}, nil
+}
+
+type dsnConnector struct {
+	driver driver.Driver
+	dsn    string
+}
+
+func (c dsnConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	return c.driver.Open(c.dsn)
+}
+
+func (c dsnConnector) Driver() driver.Driver {
+	return c.driver
+}
@@ -0,0 +1,77 @@
+// Package sqllex 提供 db 和它的子包共用的 SQL 词法辅助函数.
+// 它只识别字符串, 标识符和注释, 用于在不解析 SQL 的情况下跳过它们, 不是完整的词法分析器.
+package sqllex
+
+import (
+	"regexp"
+	"strings"
+)
+
+// MySQL 判断驱动 driverName 是否使用 MySQL 的词法: 字符串中的反斜杠是转义字符, # 开始单行注释.
+// PostgreSQL(standard_conforming_strings 默认打开)和 SQLite 都不是, PostgreSQL 的 # 是按位异或运算符.
+func MySQL(driverName string) bool {
+	return driverName == "mysql"
+}
+
+// SkipQuoted 返回从 s[start] 开始的引号字符串之后的位置, 支持两个引号的转义;
+// backslash 为 true 时也支持反斜杠转义, 见 MySQL.
+func SkipQuoted(s string, start int, quote byte, backslash bool) int {
+	for i := start + 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if backslash {
+				i++
+			}
+		case quote:
+			if i+1 < len(s) && s[i+1] == quote {
+				i++
+				continue
+			}
+			return i + 1
+		}
+	}
+	return len(s)
+}
+
+// SkipComment 返回从 s[start] 开始的注释之后的位置, s[start] 不是注释的开始时返回 start.
+// 支持 -- 和 /* */ 注释, mysql 为 true 时也支持 # 注释, 见 MySQL.
+func SkipComment(s string, start int, mysql bool) int {
+	rest := s[start:]
+	switch {
+	case strings.HasPrefix(rest, "/*"):
+		if end := strings.Index(rest[2:], "*/"); end >= 0 {
+			return start + end + 4
+		}
+		return len(s)
+	case strings.HasPrefix(rest, "--") || mysql && strings.HasPrefix(rest, "#"):
+		if end := strings.IndexByte(rest, '\n'); end >= 0 {
+			return start + end + 1
+		}
+		return len(s)
+	}
+	return start
+}
+
+var dollarTagRegexp = regexp.MustCompile(`^\$[A-Za-z_]*\$`)
+
+// SkipDollarQuoted 返回从 s[start] 开始的 PostgreSQL $tag$...$tag$ 字符串之后的位置,
+// s[start] 不是这种字符串的开始时返回 start.
+func SkipDollarQuoted(s string, start int) int {
+	tag := dollarTagRegexp.FindString(s[start:])
+	if tag == "" {
+		return start
+	}
+	if end := strings.Index(s[start+len(tag):], tag); end >= 0 {
+		return start + len(tag) + end + len(tag)
+	}
+	return len(s)
+}
+
+func IsDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// IsIdentByte 判断 c 是否可以出现在没有引号的标识符中, 非 ASCII 字符都算.
+func IsIdentByte(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || IsDigit(c) || c >= 0x80
+}
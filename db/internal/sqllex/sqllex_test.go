@@ -0,0 +1,29 @@
+package sqllex
+
+import "testing"
+
+func TestSkip(t *testing.T) {
+	tests := []struct {
+		name string
+		skip func(s string) int
+		s    string
+		want int
+	}{
+		{"quoted", func(s string) int { return SkipQuoted(s, 0, '\'', false) }, "'a''b' x", 6},
+		{"backslash", func(s string) int { return SkipQuoted(s, 0, '\'', true) }, `'a\'b' x`, 6},
+		{"no backslash", func(s string) int { return SkipQuoted(s, 0, '\'', false) }, `'a\' x`, 4},
+		{"unterminated", func(s string) int { return SkipQuoted(s, 0, '"', false) }, `"abc`, 4},
+		{"line comment", func(s string) int { return SkipComment(s, 0, false) }, "-- a\nb", 5},
+		{"block comment", func(s string) int { return SkipComment(s, 0, false) }, "/* a */b", 7},
+		{"hash mysql", func(s string) int { return SkipComment(s, 0, true) }, "# a\nb", 4},
+		{"hash postgres", func(s string) int { return SkipComment(s, 0, false) }, "#>'{a}'", 0},
+		{"not comment", func(s string) int { return SkipComment(s, 0, true) }, "-1", 0},
+		{"dollar", func(s string) int { return SkipDollarQuoted(s, 0) }, "$f$ a $$ b $f$ c", 14},
+		{"dollar param", func(s string) int { return SkipDollarQuoted(s, 0) }, "$1", 0},
+	}
+	for _, tt := range tests {
+		if got := tt.skip(tt.s); got != tt.want {
+			t.Errorf("%s: skip(%q) = %d, want %d", tt.name, tt.s, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// errFail 是语句中包含 FAIL 时 fakeDB 返回的错误.
+var errFail = errors.New("fake: statement failed")
+
+// fakeDB 是测试用的 database/sql/driver 实现, 模拟 MySQL 的 advisory lock 和版本表,
+// 记录执行的语句; 版本表的修改在事务提交之后才生效.
+type fakeDB struct {
+	mutex    sync.Mutex
+	ops      []string // 比如 "exec CREATE TABLE a", "begin", "commit", "lock", "unlock"
+	created  bool
+	versions map[int64]string // map[version]name
+	busy     bool             // 为 true 时 GET_LOCK 超时
+}
+
+func newFakeDB(t *testing.T) (*sqlx.DB, *fakeDB) {
+	f := &fakeDB{versions: make(map[int64]string)}
+	d := sql.OpenDB(f)
+	t.Cleanup(func() {
+		d.Close()
+	})
+	return sqlx.NewDb(d, "mysql"), f
+}
+
+func (f *fakeDB) record(op string) {
+	f.ops = append(f.ops, op)
+}
+
+// execs 返回执行过的迁移语句, 不包括版本表和锁的操作.
+func (f *fakeDB) execs() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	var execs []string
+	for _, op := range f.ops {
+		if strings.HasPrefix(op, "exec ") && !strings.Contains(op, "schema_migrations") && !strings.Contains(op, "_LOCK") {
+			execs = append(execs, strings.TrimPrefix(op, "exec "))
+		}
+	}
+	return execs
+}
+
+func (f *fakeDB) applied() map[int64]string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	applied := make(map[int64]string)
+	for version, name := range f.versions {
+		applied[version] = name
+	}
+	return applied
+}
+
+func (f *fakeDB) Connect(ctx context.Context) (driver.Conn, error) {
+	return &fakeConn{f: f}, nil
+}
+
+func (f *fakeDB) Driver() driver.Driver {
+	return f
+}
+
+func (f *fakeDB) Open(name string) (driver.Conn, error) {
+	return &fakeConn{f: f}, nil
+}
+
+type fakeConn struct {
+	f       *fakeDB
+	pending []func() // 事务中对版本表的修改, nil 表示不在事务中
+	inTx    bool
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{c: c, query: query}, nil
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	c.f.mutex.Lock()
+	defer c.f.mutex.Unlock()
+	c.f.record("begin")
+	c.inTx, c.pending = true, nil
+	return c, nil
+}
+
+func (c *fakeConn) Commit() error {
+	c.f.mutex.Lock()
+	defer c.f.mutex.Unlock()
+	c.f.record("commit")
+	for _, fn := range c.pending {
+		fn()
+	}
+	c.inTx, c.pending = false, nil
+	return nil
+}
+
+func (c *fakeConn) Rollback() error {
+	c.f.mutex.Lock()
+	defer c.f.mutex.Unlock()
+	c.f.record("rollback")
+	c.inTx, c.pending = false, nil
+	return nil
+}
+
+type fakeStmt struct {
+	c     *fakeConn
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	f := s.c.f
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.record("exec " + s.query)
+	var change func()
+	switch {
+	case strings.Contains(s.query, "FAIL"):
+		return nil, errFail
+	case strings.HasPrefix(s.query, "CREATE TABLE IF NOT EXISTS schema_migrations"):
+		f.created = true
+	case strings.HasPrefix(s.query, "INSERT INTO schema_migrations"):
+		change = func() { f.versions[args[0].(int64)] = args[1].(string) }
+	case strings.HasPrefix(s.query, "DELETE FROM schema_migrations"):
+		change = func() { delete(f.versions, args[0].(int64)) }
+	case strings.HasPrefix(s.query, "SELECT RELEASE_LOCK"):
+		f.record("unlock")
+	}
+	if change != nil {
+		if s.c.inTx {
+			s.c.pending = append(s.c.pending, change)
+		} else {
+			change()
+		}
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	f := s.c.f
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.record("query " + s.query)
+	switch {
+	case strings.HasPrefix(s.query, "SELECT GET_LOCK"):
+		if f.busy {
+			return &fakeRows{columns: []string{"got"}, rows: [][]driver.Value{{int64(0)}}}, nil
+		}
+		f.record("lock")
+		return &fakeRows{columns: []string{"got"}, rows: [][]driver.Value{{int64(1)}}}, nil
+	case strings.Contains(s.query, "information_schema.tables"):
+		n := int64(0)
+		if f.created {
+			n = 1
+		}
+		return &fakeRows{columns: []string{"n"}, rows: [][]driver.Value{{n}}}, nil
+	case strings.HasPrefix(s.query, "SELECT version, name, applied_at FROM schema_migrations"):
+		r := &fakeRows{columns: []string{"version", "name", "applied_at"}}
+		for version, name := range f.versions {
+			r.rows = append(r.rows, []driver.Value{version, name, int64(1600000000)})
+		}
+		return r, nil
+	}
+	return &fakeRows{}, nil
+}
+
+type fakeRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.columns }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
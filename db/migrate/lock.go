@@ -0,0 +1,60 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// ErrLocked 表示在 LockTimeout 之内没有获取到 advisory lock, 另一个实例正在执行迁移.
+var ErrLocked = errors.New("migrate: another migration is in progress")
+
+// lock 在 conn 上获取 advisory lock, 返回释放锁的函数.
+// 锁的名字是版本表的表名, 使用不同版本表的 Migrator 互不影响.
+func (m *Migrator) lock(ctx context.Context, conn *sqlx.Conn, driverName string) (unlock func(), err error) {
+	timeout := m.LockTimeout
+	if timeout <= 0 {
+		timeout = time.Minute
+	}
+	name := m.table()
+
+	switch driverName {
+	case "mysql":
+		var got *int64
+		err = conn.GetContext(ctx, &got, "SELECT GET_LOCK(?, ?)", name, int64(timeout/time.Second))
+		if err != nil {
+			return nil, err
+		}
+		if got == nil || *got != 1 {
+			return nil, ErrLocked
+		}
+		return func() {
+			conn.ExecContext(context.Background(), "SELECT RELEASE_LOCK(?)", name)
+		}, nil
+
+	case "postgres", "pgx":
+		key := lockKey(name)
+		lockCtx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		if _, err = conn.ExecContext(lockCtx, "SELECT pg_advisory_lock($1)", key); err != nil {
+			if lockCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+				return nil, ErrLocked
+			}
+			return nil, err
+		}
+		return func() {
+			conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", key)
+		}, nil
+	}
+
+	return func() {}, nil
+}
+
+func lockKey(name string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte("migrate:" + name))
+	return int64(h.Sum64())
+}
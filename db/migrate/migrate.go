@@ -0,0 +1,316 @@
+// Package migrate 执行数据库的 schema 迁移.
+//
+// 迁移文件从 fs.FS 读取, 所以可以使用 embed:
+//
+//	//go:embed migrations/*.sql
+//	var files embed.FS
+//
+//	sub, _ := fs.Sub(files, "migrations")
+//	m, err := migrate.New(sub)
+//	if err != nil {
+//		return err
+//	}
+//	err = m.Up(ctx)
+//
+// 已经执行的版本记录在 schema_migrations 表中, 每个迁移和它的版本记录在同一个事务中执行.
+// 执行迁移之前先获取数据库的 advisory lock(MySQL 的 GET_LOCK, PostgreSQL 的 pg_advisory_lock),
+// 多个实例同时启动时只有一个执行迁移, 其他的等待它完成; 其他数据库不加锁.
+//
+// 注意 MySQL 的 DDL 会隐式提交事务, 包含多条 DDL 的迁移中途失败时需要手工处理.
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+	"time"
+
+	"github.com/aiyi/go/db"
+	"github.com/jmoiron/sqlx"
+)
+
+// ErrNoDB 表示没有设置 Migrator.DB, db.GetDB() 也返回 nil.
+var ErrNoDB = errors.New("migrate: no database")
+
+// Migrator 执行迁移, 使用 New 创建.
+type Migrator struct {
+	// DB 是执行迁移的数据库, 为 nil 时使用 db.GetDB().
+	DB *sqlx.DB
+
+	// Table 是记录版本的表名, 默认 schema_migrations.
+	Table string
+
+	// LockTimeout 等待 advisory lock 的最长时间, 默认 1 分钟.
+	LockTimeout time.Duration
+
+	migrations []*Migration
+}
+
+// New 从 fsys 读取迁移文件并创建 Migrator, 文件名的格式见 Load.
+func New(fsys fs.FS) (*Migrator, error) {
+	migrations, err := Load(fsys)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{migrations: migrations}, nil
+}
+
+// Migrations 返回所有的迁移, 按照版本从小到大排列.
+func (m *Migrator) Migrations() []*Migration {
+	return m.migrations
+}
+
+// Status 是一个迁移的状态.
+type Status struct {
+	Version   int64
+	Name      string
+	Applied   bool
+	AppliedAt time.Time // 没有执行时为零值
+	Missing   bool      // 已经执行, 但是没有对应的迁移文件
+}
+
+// Status 返回所有迁移的状态, 按照版本从小到大排列.
+// Status 是只读的: 不获取 advisory lock, 版本表不存在时不创建, 所有迁移都是没有执行.
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	var result []Status
+	err := m.run(ctx, false, func(_ *session, applied map[int64]*appliedVersion) error {
+		for _, mig := range m.migrations {
+			st := Status{Version: mig.Version, Name: mig.Name}
+			if a := applied[mig.Version]; a != nil {
+				st.Applied, st.AppliedAt = true, time.Unix(a.AppliedAt, 0)
+				delete(applied, mig.Version)
+			}
+			result = append(result, st)
+		}
+		for _, a := range applied {
+			result = append(result, Status{
+				Version:   a.Version,
+				Name:      a.Name,
+				Applied:   true,
+				AppliedAt: time.Unix(a.AppliedAt, 0),
+				Missing:   true,
+			})
+		}
+		return nil
+	})
+	sort.Slice(result, func(i, j int) bool { return result[i].Version < result[j].Version })
+	return result, err
+}
+
+// Up 按照版本从小到大执行所有没有执行过的迁移.
+func (m *Migrator) Up(ctx context.Context) error {
+	return m.run(ctx, true, func(s *session, applied map[int64]*appliedVersion) error {
+		for _, mig := range m.migrations {
+			if applied[mig.Version] == nil {
+				if err := m.apply(ctx, s, mig, true); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// Down 按照版本从大到小回滚最近执行的 n 个迁移.
+func (m *Migrator) Down(ctx context.Context, n int) error {
+	return m.run(ctx, true, func(s *session, applied map[int64]*appliedVersion) error {
+		versions := appliedVersions(applied)
+		for i := len(versions) - 1; i >= 0 && n > 0; i, n = i-1, n-1 {
+			if err := m.rollback(ctx, s, versions[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Goto 迁移到 version: 回滚所有大于 version 的已经执行的迁移, 然后执行所有不大于 version 的没有执行的迁移.
+// version 为 0 表示回滚所有迁移.
+func (m *Migrator) Goto(ctx context.Context, version int64) error {
+	if version != 0 && m.find(version) == nil {
+		return fmt.Errorf("migrate: unknown version %d", version)
+	}
+
+	return m.run(ctx, true, func(s *session, applied map[int64]*appliedVersion) error {
+		versions := appliedVersions(applied)
+		for i := len(versions) - 1; i >= 0 && versions[i] > version; i-- {
+			if err := m.rollback(ctx, s, versions[i]); err != nil {
+				return err
+			}
+		}
+		for _, mig := range m.migrations {
+			if mig.Version > version {
+				break
+			}
+			if applied[mig.Version] == nil {
+				if err := m.apply(ctx, s, mig, true); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (m *Migrator) find(version int64) *Migration {
+	for _, mig := range m.migrations {
+		if mig.Version == version {
+			return mig
+		}
+	}
+	return nil
+}
+
+func (m *Migrator) table() string {
+	if m.Table == "" {
+		return "schema_migrations"
+	}
+	return m.Table
+}
+
+type appliedVersion struct {
+	Version   int64  `db:"version"`
+	Name      string `db:"name"`
+	AppliedAt int64  `db:"applied_at"`
+}
+
+func appliedVersions(applied map[int64]*appliedVersion) []int64 {
+	versions := make([]int64, 0, len(applied))
+	for version := range applied {
+		versions = append(versions, version)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i] < versions[j] })
+	return versions
+}
+
+// session 是执行迁移的连接.
+type session struct {
+	conn       *sqlx.Conn
+	driverName string
+}
+
+// run 在一个连接上执行 fn. write 为 true 时先获取 advisory lock 并创建版本表;
+// 为 false 时只读取版本表, 不存在时 applied 为空.
+// 所有操作使用同一个连接, advisory lock 属于这个连接, MaxOpenConns 为 1 时也不会死锁.
+func (m *Migrator) run(ctx context.Context, write bool, fn func(s *session, applied map[int64]*appliedVersion) error) error {
+	d := m.DB
+	if d == nil {
+		d = db.GetDB()
+	}
+	if d == nil {
+		return ErrNoDB
+	}
+
+	conn, err := d.Connx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	s := &session{conn: conn, driverName: d.DriverName()}
+
+	applied := make(map[int64]*appliedVersion)
+	if write {
+		unlock, err := m.lock(ctx, conn, s.driverName)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+
+		_, err = conn.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS "+m.table()+
+			" (version BIGINT NOT NULL PRIMARY KEY, name VARCHAR(255) NOT NULL, applied_at BIGINT NOT NULL)")
+		if err != nil {
+			return err
+		}
+	} else {
+		exists, err := m.tableExists(ctx, s)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fn(s, applied)
+		}
+	}
+
+	var rows []*appliedVersion
+	if err = conn.SelectContext(ctx, &rows, "SELECT version, name, applied_at FROM "+m.table()); err != nil {
+		return err
+	}
+	for _, a := range rows {
+		applied[a.Version] = a
+	}
+
+	return fn(s, applied)
+}
+
+// tableExists 判断版本表是否存在.
+func (m *Migrator) tableExists(ctx context.Context, s *session) (bool, error) {
+	var query string
+	switch s.driverName {
+	case "mysql":
+		query = "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = DATABASE() AND table_name = ?"
+	case "postgres", "pgx":
+		query = "SELECT COUNT(to_regclass($1))"
+	case "sqlite3", "sqlite":
+		query = "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?"
+	default:
+		query = sqlx.Rebind(sqlx.BindType(s.driverName), "SELECT COUNT(*) FROM information_schema.tables WHERE table_name = ?")
+	}
+	var n int
+	if err := s.conn.GetContext(ctx, &n, query, m.table()); err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func (m *Migrator) rollback(ctx context.Context, s *session, version int64) error {
+	mig := m.find(version)
+	if mig == nil {
+		return fmt.Errorf("migrate: no migration file for applied version %d", version)
+	}
+	if mig.Down == "" {
+		return fmt.Errorf("migrate: version %d (%s) has no down migration", mig.Version, mig.Name)
+	}
+	return m.apply(ctx, s, mig, false)
+}
+
+// apply 在一个事务中执行迁移并更新版本记录.
+func (m *Migrator) apply(ctx context.Context, s *session, mig *Migration, up bool) (err error) {
+	body, direction := mig.Up, "up"
+	if !up {
+		body, direction = mig.Down, "down"
+	}
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("migrate: %d_%s.%s.sql: %w", mig.Version, mig.Name, direction, err)
+		}
+	}()
+
+	tx, err := s.conn.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	for _, stmt := range splitStatements(body, s.driverName) {
+		if _, err = tx.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+
+	if up {
+		_, err = tx.ExecContext(ctx, tx.Rebind("INSERT INTO "+m.table()+" (version, name, applied_at) VALUES (?, ?, ?)"),
+			mig.Version, mig.Name, time.Now().Unix())
+	} else {
+		_, err = tx.ExecContext(ctx, tx.Rebind("DELETE FROM "+m.table()+" WHERE version=?"), mig.Version)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
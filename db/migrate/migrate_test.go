@@ -0,0 +1,195 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func newTestMigrator(t *testing.T, fsys fstest.MapFS) (*Migrator, *fakeDB) {
+	t.Helper()
+	m, err := New(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, f := newFakeDB(t)
+	m.DB = d
+	return m, f
+}
+
+var testFiles = fstest.MapFS{
+	"0001_users.up.sql":    {Data: []byte("CREATE TABLE users (id INT);\nCREATE INDEX users_id ON users (id);")},
+	"0001_users.down.sql":  {Data: []byte("DROP TABLE users")},
+	"0002_orders.up.sql":   {Data: []byte("CREATE TABLE orders (id INT)")},
+	"0002_orders.down.sql": {Data: []byte("DROP TABLE orders")},
+	"0003_items.up.sql":    {Data: []byte("CREATE TABLE items (id INT)")},
+	"0003_items.down.sql":  {Data: []byte("DROP TABLE items")},
+}
+
+func TestUpDown(t *testing.T) {
+	m, f := newTestMigrator(t, testFiles)
+	ctx := context.Background()
+
+	if err := m.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"CREATE TABLE users (id INT)", "CREATE INDEX users_id ON users (id)", "CREATE TABLE orders (id INT)", "CREATE TABLE items (id INT)"}
+	if got := f.execs(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Up executed %q, want %q", got, want)
+	}
+	if got := f.applied(); !reflect.DeepEqual(got, map[int64]string{1: "users", 2: "orders", 3: "items"}) {
+		t.Errorf("applied = %v", got)
+	}
+
+	// 已经执行的迁移不会再执行
+	if err := m.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(f.execs()); n != len(want) {
+		t.Errorf("second Up executed %d statements", n-len(want))
+	}
+
+	if err := m.Down(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+	want = append(want, "DROP TABLE items", "DROP TABLE orders")
+	if got := f.execs(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Down executed %q, want %q", got, want)
+	}
+	if got := f.applied(); !reflect.DeepEqual(got, map[int64]string{1: "users"}) {
+		t.Errorf("applied = %v", got)
+	}
+}
+
+func TestGoto(t *testing.T) {
+	m, f := newTestMigrator(t, testFiles)
+	ctx := context.Background()
+
+	if err := m.Goto(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.applied(); !reflect.DeepEqual(got, map[int64]string{1: "users", 2: "orders"}) {
+		t.Errorf("Goto 2: applied = %v", got)
+	}
+	if err := m.Goto(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.applied(); len(got) != 0 {
+		t.Errorf("Goto 0: applied = %v", got)
+	}
+	if err := m.Goto(ctx, 9); err == nil {
+		t.Error("unknown version: no error")
+	}
+}
+
+func TestStatus(t *testing.T) {
+	m, f := newTestMigrator(t, testFiles)
+	ctx := context.Background()
+
+	status, err := m.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status) != 3 || status[0].Applied || status[2].Applied {
+		t.Errorf("status before Up = %+v", status)
+	}
+	for _, op := range f.ops {
+		if strings.HasPrefix(op, "exec CREATE TABLE IF NOT EXISTS") || op == "lock" {
+			t.Fatalf("Status is not read-only: %q", op)
+		}
+	}
+
+	if err := m.Goto(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	// 已经执行但是没有迁移文件的版本
+	f.mutex.Lock()
+	f.versions[7] = "gone"
+	f.mutex.Unlock()
+
+	status, err = m.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status) != 4 || !status[0].Applied || status[0].AppliedAt.IsZero() || status[1].Applied {
+		t.Errorf("status = %+v", status)
+	}
+	if last := status[3]; last.Version != 7 || !last.Applied || !last.Missing {
+		t.Errorf("missing version = %+v", last)
+	}
+	if err := m.Down(ctx, 1); err == nil {
+		t.Error("rolling back a version without migration file: no error")
+	}
+}
+
+func TestFailedMigration(t *testing.T) {
+	m, f := newTestMigrator(t, fstest.MapFS{
+		"0001_users.up.sql": {Data: []byte("CREATE TABLE users (id INT)")},
+		"0002_bad.up.sql":   {Data: []byte("CREATE TABLE bad (id INT); FAIL")},
+		"0003_next.up.sql":  {Data: []byte("CREATE TABLE next (id INT)")},
+	})
+	ctx := context.Background()
+
+	err := m.Up(ctx)
+	if !errors.Is(err, errFail) || !strings.Contains(err.Error(), "2_bad.up.sql") {
+		t.Fatalf("err = %v", err)
+	}
+	// 失败的迁移和它的版本记录一起回滚, 之后的迁移不执行
+	if got := f.applied(); !reflect.DeepEqual(got, map[int64]string{1: "users"}) {
+		t.Errorf("applied = %v", got)
+	}
+	if f.ops[len(f.ops)-1] != "unlock" {
+		t.Errorf("lock is not released: ops = %q", f.ops)
+	}
+	for _, stmt := range f.execs() {
+		if stmt == "CREATE TABLE next (id INT)" {
+			t.Error("migration after the failed one is executed")
+		}
+	}
+
+	// 没有 down 文件的迁移不能回滚
+	if err := m.Down(ctx, 1); err == nil || !strings.Contains(err.Error(), "no down migration") {
+		t.Errorf("Down = %v", err)
+	}
+}
+
+func TestLock(t *testing.T) {
+	m, f := newTestMigrator(t, testFiles)
+	ctx := context.Background()
+
+	if err := m.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	var locks []string
+	for _, op := range f.ops {
+		if op == "lock" || op == "unlock" || op == "begin" {
+			locks = append(locks, op)
+		}
+	}
+	if len(locks) < 2 || locks[0] != "lock" || locks[len(locks)-1] != "unlock" {
+		t.Errorf("migrations are not run inside the lock: %q", locks)
+	}
+
+	f.mutex.Lock()
+	f.busy = true
+	f.mutex.Unlock()
+	if err := m.Down(ctx, 1); err != ErrLocked {
+		t.Errorf("err = %v, want ErrLocked", err)
+	}
+	if got := f.applied(); len(got) != 3 {
+		t.Errorf("applied = %v", got)
+	}
+}
+
+func TestNoDB(t *testing.T) {
+	m, err := New(testFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Up(context.Background()); err != ErrNoDB {
+		t.Errorf("err = %v, want ErrNoDB", err)
+	}
+}
@@ -0,0 +1,139 @@
+package migrate
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aiyi/go/db/internal/sqllex"
+)
+
+// Migration 是一个版本的迁移, Down 为空表示不能回滚.
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+var fileRegexp = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+
+// Load 从 fsys 的根目录读取迁移文件, 文件名的格式是 <版本>_<名称>.up.sql 和 <版本>_<名称>.down.sql,
+// 比如 0001_create_users.up.sql; 返回的迁移按照版本从小到大排列.
+// 不以 .sql 结尾的文件被忽略, 格式不对的 .sql 文件返回错误.
+func Load(fsys fs.FS) ([]*Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	versions := make(map[int64]*Migration)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || path.Ext(name) != ".sql" {
+			continue
+		}
+
+		match := fileRegexp.FindStringSubmatch(name)
+		if match == nil {
+			return nil, fmt.Errorf("migrate: invalid migration file name %q", name)
+		}
+		version, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("migrate: invalid version in %q", name)
+		}
+
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+
+		m := versions[version]
+		if m == nil {
+			m = &Migration{Version: version, Name: match[2]}
+			versions[version] = m
+		} else if m.Name != match[2] {
+			return nil, fmt.Errorf("migrate: version %d has different names %q and %q", version, m.Name, match[2])
+		}
+
+		body := &m.Up
+		if match[3] == "down" {
+			body = &m.Down
+		}
+		if *body != "" {
+			return nil, fmt.Errorf("migrate: duplicate %s migration for version %d", match[3], version)
+		}
+		*body = string(data)
+		if strings.TrimSpace(*body) == "" {
+			return nil, fmt.Errorf("migrate: %s is empty", name)
+		}
+	}
+
+	migrations := make([]*Migration, 0, len(versions))
+	for _, m := range versions {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migrate: version %d has no up migration", m.Version)
+		}
+		migrations = append(migrations, m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// splitStatements 按照分号把 SQL 分成多条语句, 忽略引号, 注释和 PostgreSQL 的 $tag$ 字符串中的分号,
+// 这样不需要打开 MySQL 驱动的 multiStatements. 字符串和注释的词法随驱动不同, 见 sqllex.MySQL.
+func splitStatements(sql, driverName string) []string {
+	mysql := sqllex.MySQL(driverName)
+	var stmts []string
+	add := func(stmt string) {
+		if stmt = strings.TrimSpace(stmt); stmt != "" && !isComment(stmt, mysql) {
+			stmts = append(stmts, stmt)
+		}
+	}
+
+	start := 0
+	for i := 0; i < len(sql); {
+		if end := sqllex.SkipComment(sql, i, mysql); end > i {
+			i = end
+			continue
+		}
+		c := sql[i]
+		switch {
+		case c == '\'' || c == '"' || c == '`':
+			i = sqllex.SkipQuoted(sql, i, c, mysql)
+		case c == '$':
+			if end := sqllex.SkipDollarQuoted(sql, i); end > i {
+				i = end
+			} else {
+				i++
+			}
+		case c == ';':
+			add(sql[start:i])
+			i++
+			start = i
+		default:
+			i++
+		}
+	}
+	add(sql[start:])
+	return stmts
+}
+
+// isComment 判断 stmt 是否只包含注释.
+func isComment(stmt string, mysql bool) bool {
+	for i := 0; i < len(stmt); {
+		switch end := sqllex.SkipComment(stmt, i, mysql); {
+		case end > i:
+			i = end
+		case stmt[i] == ' ' || stmt[i] == '\t' || stmt[i] == '\n' || stmt[i] == '\r':
+			i++
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,61 @@
+package migrate
+
+import (
+	"reflect"
+	"testing"
+	"testing/fstest"
+)
+
+func TestSplitStatements(t *testing.T) {
+	tests := []struct {
+		driverName string
+		sql        string
+		want       []string
+	}{
+		{"mysql", "CREATE TABLE a (id INT);\nCREATE TABLE b (id INT);\n", []string{"CREATE TABLE a (id INT)", "CREATE TABLE b (id INT)"}},
+		{"mysql", "-- only a comment;\n/* x; */", nil},
+		{"mysql", "INSERT INTO a VALUES ('x;y'); # c;\nSELECT 1", []string{"INSERT INTO a VALUES ('x;y')", "# c;\nSELECT 1"}},
+		{"mysql", "INSERT INTO a VALUES ('it\\'s;'); SELECT 2", []string{"INSERT INTO a VALUES ('it\\'s;')", "SELECT 2"}},
+		{"mysql", "SELECT `a;b` FROM t; SELECT 'x''y;'", []string{"SELECT `a;b` FROM t", "SELECT 'x''y;'"}},
+		{"postgres", "INSERT INTO a VALUES ('C:\\'); SELECT 2", []string{"INSERT INTO a VALUES ('C:\\')", "SELECT 2"}},
+		{"postgres", "SELECT 1 # 2; SELECT 3", []string{"SELECT 1 # 2", "SELECT 3"}},
+		{"postgres", "CREATE FUNCTION f() RETURNS int AS $body$ SELECT 1; $body$ LANGUAGE sql; SELECT f()",
+			[]string{"CREATE FUNCTION f() RETURNS int AS $body$ SELECT 1; $body$ LANGUAGE sql", "SELECT f()"}},
+		{"postgres", "DO $$ BEGIN PERFORM 1; END $$; SELECT $1", []string{"DO $$ BEGIN PERFORM 1; END $$", "SELECT $1"}},
+	}
+	for _, tt := range tests {
+		if got := splitStatements(tt.sql, tt.driverName); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitStatements(%q, %q) = %q, want %q", tt.sql, tt.driverName, got, tt.want)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	fsys := fstest.MapFS{
+		"0002_add_name.up.sql": {Data: []byte("ALTER TABLE users ADD name TEXT")},
+		"0001_users.up.sql":    {Data: []byte("CREATE TABLE users (id INT)")},
+		"0001_users.down.sql":  {Data: []byte("DROP TABLE users")},
+		"README.md":            {Data: []byte("ignored")},
+	}
+	migrations, err := Load(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) != 2 || migrations[0].Version != 1 || migrations[1].Version != 2 {
+		t.Fatalf("migrations = %+v", migrations)
+	}
+	if migrations[0].Name != "users" || migrations[0].Down != "DROP TABLE users" || migrations[1].Down != "" {
+		t.Errorf("migration 1 = %+v", migrations[0])
+	}
+
+	for name, fsys := range map[string]fstest.MapFS{
+		"bad name": {"users.up.sql": {Data: []byte("SELECT 1")}},
+		"no up":    {"0001_users.down.sql": {Data: []byte("SELECT 1")}},
+		"empty":    {"0001_users.up.sql": {Data: []byte(" \n")}},
+		"mismatch": {"0001_a.up.sql": {Data: []byte("SELECT 1")}, "0001_b.down.sql": {Data: []byte("SELECT 1")}},
+	} {
+		if _, err := Load(fsys); err == nil {
+			t.Errorf("%s: Load succeeded", name)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package db
+
+import (
+	"context"
+	"io"
+	"math"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// node 是一个 sqlx.DB 以及在它上面创建的 Stmt 缓存, 主库和每个从库各是一个 node.
+type node struct {
+	name         string // "primary" 或者 "replica0", "replica1", ...
+	db           *sqlx.DB
+	stmtSet      *stmtCache // map[query]*sqlx.Stmt
+	namedStmtSet *stmtCache // map[query]*sqlx.NamedStmt
+}
+
+func newNode(name string, d *sqlx.DB, opts CacheOptions) *node {
+	n := &node{name: name, db: d}
+	n.stmtSet = newStmtCache(n.driverName(), opts)
+	n.namedStmtSet = newStmtCache(n.driverName(), opts)
+	return n
+}
+
+func (n *node) setCacheOptions(opts CacheOptions) {
+	n.stmtSet.setOptions(opts)
+	n.namedStmtSet.setOptions(opts)
+}
+
+func (n *node) closeAllStmt() {
+	n.stmtSet.purge()
+	n.namedStmtSet.purge()
+}
+
+// close 关闭所有缓存的 Stmt 并停止缓存, 用于被 SetDB 和 SetReplicas 替换掉的 node, 见 stmtCache.close.
+func (n *node) close() {
+	n.stmtSet.close()
+	n.namedStmtSet.close()
+}
+
+func (n *node) stats() NodeStats {
+	return NodeStats{
+		Name:      n.name,
+		Stmt:      n.stmtSet.stats(),
+		NamedStmt: n.namedStmtSet.stats(),
+	}
+}
+
+func (n *node) clean(opts CleanerOptions) {
+	n.stmtSet.clean(opts)
+	n.namedStmtSet.clean(opts)
+}
+
+// driverName 返回驱动名, 还没有设置 sqlx.DB 时返回空字符串.
+func (n *node) driverName() string {
+	if n.db == nil {
+		return ""
+	}
+	return n.db.DriverName()
+}
+
+// inUse 返回正在使用的连接数, 用于 LeastInFlight; 没有设置数据库的 node 返回 math.MaxInt32, 尽量不选中它.
+func (n *node) inUse() int {
+	if n.db == nil {
+		return math.MaxInt32
+	}
+	return n.db.Stats().InUse
+}
+
+// guardFunc 是 Handle.guard, 由 node 在真正创建 Stmt 之前调用; 为 nil 表示调用者已经检查过.
+type guardFunc func(ctx context.Context) (done func(err error), err error)
+
+// getStmt 返回 query 对应的 Stmt, 调用者不需要释放, 见 stmtCache.get.
+func (n *node) getStmt(ctx context.Context, query string, guard guardFunc) (*sqlx.Stmt, error) {
+	v, err := n.stmtSet.get(ctx, query, guarded(guard, n.prepare(query)))
+	if err != nil {
+		return nil, err
+	}
+	return v.(*sqlx.Stmt), nil
+}
+
+func (n *node) getNamedStmt(ctx context.Context, query string, guard guardFunc) (*sqlx.NamedStmt, error) {
+	v, err := n.namedStmtSet.get(ctx, query, guarded(guard, n.prepareNamed(query)))
+	if err != nil {
+		return nil, err
+	}
+	return v.(*sqlx.NamedStmt), nil
+}
+
+// acquireStmt 返回 query 对应的 Stmt, 使用完之后必须调用 release, 见 stmtCache.acquire.
+func (n *node) acquireStmt(ctx context.Context, query string, guard guardFunc) (stmt *sqlx.Stmt, release func(), err error) {
+	entry, err := n.stmtSet.acquire(ctx, query, guarded(guard, n.prepare(query)))
+	if err != nil {
+		return nil, nil, err
+	}
+	return entry.stmt.(*sqlx.Stmt), func() { n.stmtSet.release(entry) }, nil
+}
+
+func (n *node) acquireNamedStmt(ctx context.Context, query string, guard guardFunc) (stmt *sqlx.NamedStmt, release func(), err error) {
+	entry, err := n.namedStmtSet.acquire(ctx, query, guarded(guard, n.prepareNamed(query)))
+	if err != nil {
+		return nil, nil, err
+	}
+	return entry.stmt.(*sqlx.NamedStmt), func() { n.namedStmtSet.release(entry) }, nil
+}
+
+func (n *node) prepare(query string) func(ctx context.Context) (io.Closer, error) {
+	return func(ctx context.Context) (io.Closer, error) {
+		return n.db.PreparexContext(ctx, query)
+	}
+}
+
+func (n *node) prepareNamed(query string) func(ctx context.Context) (io.Closer, error) {
+	return func(ctx context.Context) (io.Closer, error) {
+		return n.db.PrepareNamedContext(ctx, query)
+	}
+}
+
+// guarded 返回先经过 guard 再执行 prepare 的函数, 只有真正访问数据库的 prepare 计入熔断器, 缓存命中不计入.
+func guarded(guard guardFunc, prepare func(ctx context.Context) (io.Closer, error)) func(ctx context.Context) (io.Closer, error) {
+	if guard == nil {
+		return prepare
+	}
+	return func(ctx context.Context) (io.Closer, error) {
+		done, err := guard(ctx)
+		if err != nil {
+			return nil, err
+		}
+		stmt, err := prepare(ctx)
+		done(err)
+		return stmt, err
+	}
+}
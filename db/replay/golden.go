@@ -0,0 +1,183 @@
+package replay
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+// Entry 是 golden 文件中的一次语句执行.
+type Entry struct {
+	Kind  string  `json:"kind"` // "exec" 或者 "query"
+	Query string  `json:"query"`
+	Args  []Value `json:"args"`
+
+	// exec 的结果
+	LastInsertID int64 `json:"last_insert_id,omitempty"`
+	RowsAffected int64 `json:"rows_affected,omitempty"`
+
+	// query 的结果
+	Columns []string  `json:"columns,omitempty"`
+	Rows    [][]Value `json:"rows,omitempty"`
+
+	// RowsError 是读取 Rows 中途的错误, 在返回录制的行之后返回
+	RowsError string `json:"rows_error,omitempty"`
+
+	Error string `json:"error,omitempty"`
+}
+
+// Golden 是 golden 文件的内容.
+type Golden struct {
+	Entries []*Entry `json:"entries"`
+}
+
+// ReadGolden 读取 golden 文件.
+func ReadGolden(path string) (*Golden, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	g := &Golden{}
+	if err = json.Unmarshal(data, g); err != nil {
+		return nil, fmt.Errorf("replay: %s: %v", path, err)
+	}
+	return g, nil
+}
+
+// WriteGolden 把 g 写到 golden 文件.
+func WriteGolden(path string, g *Golden) error {
+	data, err := json.MarshalIndent(g, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// Value 是保存了类型的 driver.Value, 在 JSON 中表示为 {"type": "int64", "value": ...}.
+type Value struct {
+	V driver.Value
+}
+
+type jsonValue struct {
+	Type  string          `json:"type"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+func (v Value) MarshalJSON() ([]byte, error) {
+	var jv jsonValue
+	var value interface{}
+	switch x := v.V.(type) {
+	case nil:
+		jv.Type = "null"
+	case int64:
+		jv.Type, value = "int64", x
+	case uint64:
+		jv.Type, value = "uint64", x
+	case float64:
+		jv.Type, value = "float64", x
+	case bool:
+		jv.Type, value = "bool", x
+	case string:
+		jv.Type, value = "string", x
+	case []byte:
+		jv.Type, value = "bytes", base64.StdEncoding.EncodeToString(x)
+	case time.Time:
+		jv.Type, value = "time", x.Format(time.RFC3339Nano)
+	default:
+		return nil, fmt.Errorf("replay: unsupported value type %T", v.V)
+	}
+
+	if value != nil {
+		raw, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		jv.Value = raw
+	}
+	return json.Marshal(jv)
+}
+
+func (v *Value) UnmarshalJSON(data []byte) error {
+	var jv jsonValue
+	if err := json.Unmarshal(data, &jv); err != nil {
+		return err
+	}
+
+	var err error
+	switch jv.Type {
+	case "null":
+		v.V = nil
+	case "int64":
+		var x int64
+		err = json.Unmarshal(jv.Value, &x)
+		v.V = x
+	case "uint64":
+		var x uint64
+		err = json.Unmarshal(jv.Value, &x)
+		v.V = x
+	case "float64":
+		var x float64
+		err = json.Unmarshal(jv.Value, &x)
+		v.V = x
+	case "bool":
+		var x bool
+		err = json.Unmarshal(jv.Value, &x)
+		v.V = x
+	case "string":
+		var x string
+		err = json.Unmarshal(jv.Value, &x)
+		v.V = x
+	case "bytes":
+		var s string
+		if err = json.Unmarshal(jv.Value, &s); err == nil {
+			v.V, err = base64.StdEncoding.DecodeString(s)
+		}
+	case "time":
+		var s string
+		if err = json.Unmarshal(jv.Value, &s); err == nil {
+			v.V, err = time.Parse(time.RFC3339Nano, s)
+		}
+	default:
+		err = fmt.Errorf("replay: unknown value type %q", jv.Type)
+	}
+	return err
+}
+
+func toValues(args []driver.NamedValue) ([]Value, error) {
+	values := make([]Value, len(args))
+	for i, arg := range args {
+		if _, err := (Value{arg.Value}).MarshalJSON(); err != nil {
+			return nil, err
+		}
+		values[i] = Value{cloneValue(arg.Value)}
+	}
+	return values, nil
+}
+
+// cloneValue 复制 []byte, 驱动可能会在下一次 Next 时重用它.
+func cloneValue(v driver.Value) driver.Value {
+	if b, ok := v.([]byte); ok && b != nil {
+		return append([]byte{}, b...)
+	}
+	return v
+}
+
+// sameArgs 判断两组参数是否相同, 按照 JSON 编码比较, 所以 time.Time 的时区等细节不影响结果.
+func sameArgs(a, b []Value) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	ja, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+	jb, err := json.Marshal(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(ja, jb)
+}
@@ -0,0 +1,227 @@
+package replay
+
+import (
+	"context"
+	"database/sql/driver"
+	"io"
+	"sync"
+
+	"github.com/aiyi/go/db/internal/driverutil"
+)
+
+// Recorder 包装一个真实的驱动, 记录所有执行的语句, 参数和结果, 使用 NewRecorder 创建.
+// Recorder 实现了 driver.Connector, 通过 sql.OpenDB 使用.
+type Recorder struct {
+	connector driver.Connector
+
+	mutex   sync.Mutex
+	entries []*Entry
+}
+
+// NewRecorder 使用已经注册的驱动 driverName 连接 dsn, 并记录经过它的语句.
+func NewRecorder(driverName, dsn string) (*Recorder, error) {
+	connector, err := driverutil.OpenConnector(driverName, dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &Recorder{connector: connector}, nil
+}
+
+func (r *Recorder) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := r.connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &recordConn{r: r, conn: conn}, nil
+}
+
+func (r *Recorder) Driver() driver.Driver {
+	return r
+}
+
+// Open 实现 driver.Driver, 忽略 name, 总是连接 NewRecorder 的 dsn.
+func (r *Recorder) Open(name string) (driver.Conn, error) {
+	return r.Connect(context.Background())
+}
+
+func (r *Recorder) add(e *Entry) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.entries = append(r.entries, e)
+}
+
+// Golden 返回到目前为止记录的内容.
+func (r *Recorder) Golden() *Golden {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return &Golden{Entries: append([]*Entry{}, r.entries...)}
+}
+
+// Save 把记录的内容写到 golden 文件.
+func (r *Recorder) Save(path string) error {
+	return WriteGolden(path, r.Golden())
+}
+
+// recordConn 只实现 Prepare 而不实现 ExecerContext 和 QueryerContext,
+// 这样所有的语句都经过 recordStmt.
+type recordConn struct {
+	r    *Recorder
+	conn driver.Conn
+}
+
+func (c *recordConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *recordConn) PrepareContext(ctx context.Context, query string) (stmt driver.Stmt, err error) {
+	if pc, ok := c.conn.(driver.ConnPrepareContext); ok {
+		stmt, err = pc.PrepareContext(ctx, query)
+	} else {
+		stmt, err = c.conn.Prepare(query)
+	}
+	if err != nil {
+		c.r.add(&Entry{Kind: "prepare", Query: query, Error: err.Error()})
+		return nil, err
+	}
+	return &recordStmt{r: c.r, query: query, stmt: stmt}, nil
+}
+
+func (c *recordConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *recordConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *recordConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if bc, ok := c.conn.(driver.ConnBeginTx); ok {
+		return bc.BeginTx(ctx, opts)
+	}
+	return c.conn.Begin()
+}
+
+// CheckNamedValue 使用真实驱动的参数转换, 记录下来的参数和直接使用真实驱动时一样.
+func (c *recordConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if checker, ok := c.conn.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+func (c *recordConn) ResetSession(ctx context.Context) error {
+	if resetter, ok := c.conn.(driver.SessionResetter); ok {
+		return resetter.ResetSession(ctx)
+	}
+	return nil
+}
+
+type recordStmt struct {
+	r     *Recorder
+	query string
+	stmt  driver.Stmt
+}
+
+func (s *recordStmt) Close() error {
+	return s.stmt.Close()
+}
+
+func (s *recordStmt) NumInput() int {
+	return s.stmt.NumInput()
+}
+
+func (s *recordStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.ExecContext(context.Background(), namedValues(args))
+}
+
+func (s *recordStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.QueryContext(context.Background(), namedValues(args))
+}
+
+func (s *recordStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	values, err := toValues(args)
+	if err != nil {
+		return nil, err
+	}
+
+	var result driver.Result
+	if ec, ok := s.stmt.(driver.StmtExecContext); ok {
+		result, err = ec.ExecContext(ctx, args)
+	} else {
+		result, err = s.stmt.Exec(plainValues(args))
+	}
+
+	e := &Entry{Kind: "exec", Query: s.query, Args: values}
+	if err != nil {
+		e.Error = err.Error()
+		s.r.add(e)
+		return nil, err
+	}
+	e.LastInsertID, _ = result.LastInsertId()
+	e.RowsAffected, _ = result.RowsAffected()
+	s.r.add(e)
+	return result, nil
+}
+
+// QueryContext 读出所有的行并记录下来, 返回的 Rows 从记录中读取.
+func (s *recordStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	values, err := toValues(args)
+	if err != nil {
+		return nil, err
+	}
+
+	var rows driver.Rows
+	if qc, ok := s.stmt.(driver.StmtQueryContext); ok {
+		rows, err = qc.QueryContext(ctx, args)
+	} else {
+		rows, err = s.stmt.Query(plainValues(args))
+	}
+
+	e := &Entry{Kind: "query", Query: s.query, Args: values}
+	if err != nil {
+		e.Error = err.Error()
+		s.r.add(e)
+		return nil, err
+	}
+	defer rows.Close()
+
+	e.Columns = rows.Columns()
+	dest := make([]driver.Value, len(e.Columns))
+	for {
+		if err = rows.Next(dest); err == io.EOF {
+			break
+		} else if err != nil {
+			// 读取中途的错误也要录制, 否则回放时会得到一个没有错误的不完整结果
+			e.RowsError = err.Error()
+			break
+		}
+
+		row := make([]Value, len(dest))
+		for i, v := range dest {
+			if _, err = (Value{v}).MarshalJSON(); err != nil {
+				return nil, err
+			}
+			row[i] = Value{cloneValue(v)}
+		}
+		e.Rows = append(e.Rows, row)
+	}
+
+	s.r.add(e)
+	return newRows(e), nil
+}
+
+func namedValues(args []driver.Value) []driver.NamedValue {
+	nvs := make([]driver.NamedValue, len(args))
+	for i, arg := range args {
+		nvs[i] = driver.NamedValue{Ordinal: i + 1, Value: arg}
+	}
+	return nvs
+}
+
+func plainValues(args []driver.NamedValue) []driver.Value {
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		values[i] = arg.Value
+	}
+	return values
+}
@@ -0,0 +1,276 @@
+// Package replay 提供一个用于测试的 database/sql/driver 实现, 有录制和回放两种模式.
+//
+// 录制模式包装一个真实的驱动, 把执行的语句, 参数和结果写到 golden 文件:
+//
+//	rec, err := replay.NewRecorder("mysql", dsn)
+//	db.SetDB(sqlx.NewDb(sql.OpenDB(rec), "mysql"))
+//	... // 执行测试
+//	err = rec.Save("testdata/orders.json")
+//
+// 回放模式从 golden 文件返回结果, 不需要数据库; 遇到没有录制过的语句或者参数返回 ErrUnexpectedQuery:
+//
+//	rp, err := replay.Load("testdata/orders.json")
+//	db.SetDB(sqlx.NewDb(sql.OpenDB(rp), "mysql"))
+//	... // 执行测试
+//	if err := rp.Done(); err != nil {
+//		t.Fatal(err)
+//	}
+//
+// 回放时语句按照 query 和参数匹配, 同样的语句和参数按照录制的顺序返回结果, 所以并发执行的测试也可以回放.
+// 事务的开始, 提交和回滚不会录制, 回放时总是成功. 录制的错误回放时只保留错误信息,
+// 依赖驱动错误类型的逻辑(比如 db.IsRetryable)在回放时不生效.
+package replay
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// ErrUnexpectedQuery 表示回放时执行了 golden 文件中没有的语句, 或者录制的结果已经用完.
+var ErrUnexpectedQuery = errors.New("replay: unexpected query")
+
+// Replayer 从录制的内容返回结果, 使用 NewReplayer 或者 Load 创建.
+// Replayer 实现了 driver.Connector, 通过 sql.OpenDB 使用.
+type Replayer struct {
+	mutex   sync.Mutex
+	entries []*Entry
+	used    []bool
+}
+
+func NewReplayer(g *Golden) *Replayer {
+	return &Replayer{
+		entries: g.Entries,
+		used:    make([]bool, len(g.Entries)),
+	}
+}
+
+// Load 读取 golden 文件并创建 Replayer.
+func Load(path string) (*Replayer, error) {
+	g, err := ReadGolden(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewReplayer(g), nil
+}
+
+func (p *Replayer) Connect(ctx context.Context) (driver.Conn, error) {
+	return &replayConn{p: p}, nil
+}
+
+func (p *Replayer) Driver() driver.Driver {
+	return p
+}
+
+// Open 实现 driver.Driver, 忽略 name.
+func (p *Replayer) Open(name string) (driver.Conn, error) {
+	return &replayConn{p: p}, nil
+}
+
+// take 返回第一个还没有使用过的, 类型, query 和参数都相同的记录.
+func (p *Replayer) take(kind, query string, args []Value) (*Entry, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for i, e := range p.entries {
+		if !p.used[i] && e.Kind == kind && e.Query == query && sameArgs(e.Args, args) {
+			p.used[i] = true
+			return e, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s %q %v", ErrUnexpectedQuery, kind, query, formatValues(args))
+}
+
+// takePrepareError 返回录制时这个 query 创建 Stmt 的错误, 没有时返回 nil.
+func (p *Replayer) takePrepareError(query string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for i, e := range p.entries {
+		if !p.used[i] && e.Kind == "prepare" && e.Query == query {
+			p.used[i] = true
+			return errors.New(e.Error)
+		}
+	}
+	return nil
+}
+
+// Remaining 返回还没有回放的记录.
+func (p *Replayer) Remaining() []*Entry {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	var remaining []*Entry
+	for i, e := range p.entries {
+		if !p.used[i] {
+			remaining = append(remaining, e)
+		}
+	}
+	return remaining
+}
+
+// Done 检查所有的记录都已经回放, 用于确认测试执行了录制时的全部语句.
+func (p *Replayer) Done() error {
+	remaining := p.Remaining()
+	if len(remaining) == 0 {
+		return nil
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "replay: %d entries not replayed:", len(remaining))
+	for _, e := range remaining {
+		fmt.Fprintf(&b, "\n\t%s %q %v", e.Kind, e.Query, formatValues(e.Args))
+	}
+	return errors.New(b.String())
+}
+
+func formatValues(values []Value) []interface{} {
+	vs := make([]interface{}, len(values))
+	for i, v := range values {
+		if b, ok := v.V.([]byte); ok {
+			vs[i] = string(b)
+		} else {
+			vs[i] = v.V
+		}
+	}
+	return vs
+}
+
+type replayConn struct {
+	p *Replayer
+}
+
+func (c *replayConn) Prepare(query string) (driver.Stmt, error) {
+	if err := c.p.takePrepareError(query); err != nil {
+		return nil, err
+	}
+	return &replayStmt{p: c.p, query: query}, nil
+}
+
+func (c *replayConn) Close() error {
+	return nil
+}
+
+func (c *replayConn) Begin() (driver.Tx, error) {
+	return replayTx{}, nil
+}
+
+// CheckNamedValue 接受 uint64, 和 MySQL 驱动一致; 其他类型使用默认的转换.
+func (c *replayConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if _, ok := nv.Value.(uint64); ok {
+		return nil
+	}
+	return driver.ErrSkip
+}
+
+type replayTx struct{}
+
+func (replayTx) Commit() error   { return nil }
+func (replayTx) Rollback() error { return nil }
+
+type replayStmt struct {
+	p     *Replayer
+	query string
+}
+
+func (s *replayStmt) Close() error {
+	return nil
+}
+
+// NumInput 返回 -1, 参数个数由匹配录制的内容来检查.
+func (s *replayStmt) NumInput() int {
+	return -1
+}
+
+func (s *replayStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.ExecContext(context.Background(), namedValues(args))
+}
+
+func (s *replayStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.QueryContext(context.Background(), namedValues(args))
+}
+
+func (s *replayStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	e, err := s.entry(ctx, "exec", args)
+	if err != nil {
+		return nil, err
+	}
+	return replayResult{e}, nil
+}
+
+func (s *replayStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	e, err := s.entry(ctx, "query", args)
+	if err != nil {
+		return nil, err
+	}
+	return newRows(e), nil
+}
+
+func (s *replayStmt) entry(ctx context.Context, kind string, args []driver.NamedValue) (*Entry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	values, err := toValues(args)
+	if err != nil {
+		return nil, err
+	}
+	e, err := s.p.take(kind, s.query, values)
+	if err != nil {
+		return nil, err
+	}
+	if e.Error != "" {
+		return nil, errors.New(e.Error)
+	}
+	return e, nil
+}
+
+type replayResult struct {
+	e *Entry
+}
+
+func (r replayResult) LastInsertId() (int64, error) {
+	return r.e.LastInsertID, nil
+}
+
+func (r replayResult) RowsAffected() (int64, error) {
+	return r.e.RowsAffected, nil
+}
+
+// rows 从录制的内容中返回行, 录制和回放模式共用.
+type rows struct {
+	columns []string
+	rows    [][]Value
+	pos     int
+	err     error // 返回所有的行之后返回的错误, 没有时是 io.EOF
+}
+
+func newRows(e *Entry) *rows {
+	r := &rows{columns: e.Columns, rows: e.Rows, err: io.EOF}
+	if e.RowsError != "" {
+		r.err = errors.New(e.RowsError)
+	}
+	return r
+}
+
+func (r *rows) Columns() []string {
+	return r.columns
+}
+
+func (r *rows) Close() error {
+	return nil
+}
+
+func (r *rows) Next(dest []driver.Value) error {
+	if r.pos >= len(r.rows) {
+		return r.err
+	}
+	for i, v := range r.rows[r.pos] {
+		dest[i] = cloneValue(v.V)
+	}
+	r.pos++
+	return nil
+}
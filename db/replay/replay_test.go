@@ -0,0 +1,251 @@
+package replay
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var fakeTime = time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+func init() {
+	sql.Register("replayfake", fakeDriver{})
+}
+
+// fakeDriver 是录制用的真实驱动: 语句 "BAD" 创建 Stmt 失败, "SELECT broken" 返回一行之后读取失败,
+// 其他的 SELECT 返回固定的两行, 其他语句影响参数个数那么多行.
+type fakeDriver struct{}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) { return fakeConn{}, nil }
+
+type fakeConn struct{}
+
+func (fakeConn) Prepare(query string) (driver.Stmt, error) {
+	if query == "BAD" {
+		return nil, errors.New("fake: syntax error")
+	}
+	return fakeStmt{query}, nil
+}
+func (fakeConn) Close() error              { return nil }
+func (fakeConn) Begin() (driver.Tx, error) { return fakeTx{}, nil }
+
+type fakeTx struct{}
+
+func (fakeTx) Commit() error   { return nil }
+func (fakeTx) Rollback() error { return nil }
+
+type fakeStmt struct {
+	query string
+}
+
+func (s fakeStmt) Close() error  { return nil }
+func (s fakeStmt) NumInput() int { return -1 }
+
+func (s fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if strings.HasPrefix(s.query, "DELETE") {
+		return nil, errors.New("fake: deadlock")
+	}
+	return fakeResult(len(args)), nil
+}
+
+func (s fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	r := &fakeRows{rows: [][]driver.Value{
+		{int64(1), "a", []byte("x"), fakeTime},
+		{int64(2), nil, nil, fakeTime},
+	}}
+	if s.query == "SELECT broken" {
+		r.rows = r.rows[:1]
+		r.err = errors.New("fake: connection lost")
+	}
+	return r, nil
+}
+
+type fakeResult int64
+
+func (r fakeResult) LastInsertId() (int64, error) { return 42, nil }
+func (r fakeResult) RowsAffected() (int64, error) { return int64(r), nil }
+
+type fakeRows struct {
+	rows [][]driver.Value
+	err  error
+}
+
+func (r *fakeRows) Columns() []string { return []string{"id", "name", "data", "at"} }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		if r.err != nil {
+			return r.err
+		}
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+type row struct {
+	ID   int64
+	Name sql.NullString
+	Data []byte
+	At   time.Time
+}
+
+// session 执行一组语句并返回可以比较的结果, 录制和回放执行同样的 session.
+func session(t *testing.T, d *sql.DB) []interface{} {
+	t.Helper()
+	ctx := context.Background()
+	var out []interface{}
+
+	result, err := d.ExecContext(ctx, "INSERT INTO t (a, b) VALUES (?, ?)", 1, "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := result.LastInsertId()
+	n, _ := result.RowsAffected()
+	out = append(out, id, n)
+
+	_, err = d.ExecContext(ctx, "DELETE FROM t WHERE a = ?", 1)
+	out = append(out, errString(err))
+
+	_, err = d.ExecContext(ctx, "BAD")
+	out = append(out, errString(err))
+
+	query := func(q string, args ...interface{}) {
+		rows, err := d.QueryContext(ctx, q, args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var r row
+			if err := rows.Scan(&r.ID, &r.Name, &r.Data, &r.At); err != nil {
+				t.Fatal(err)
+			}
+			out = append(out, r)
+		}
+		out = append(out, errString(rows.Err()))
+	}
+	query("SELECT * FROM t WHERE at < ?", fakeTime)
+	query("SELECT broken")
+
+	tx, err := d.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err = tx.ExecContext(ctx, "UPDATE t SET b = ? WHERE a = ?", []byte("y"), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, _ = result.RowsAffected()
+	out = append(out, n)
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+func TestRecordReplay(t *testing.T) {
+	rec, err := NewRecorder("replayfake", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	recDB := sql.OpenDB(rec)
+	defer recDB.Close()
+	recorded := session(t, recDB)
+
+	if recorded[len(recorded)-2] != "fake: connection lost" {
+		t.Fatalf("rows error is not returned while recording: %v", recorded)
+	}
+
+	path := filepath.Join(t.TempDir(), "golden.json")
+	if err := rec.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	rp, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rpDB := sql.OpenDB(rp)
+	defer rpDB.Close()
+	replayed := session(t, rpDB)
+
+	if !reflect.DeepEqual(replayed, recorded) {
+		t.Errorf("replayed %v\nrecorded %v", replayed, recorded)
+	}
+	if err := rp.Done(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReplayUnexpected(t *testing.T) {
+	rp := NewReplayer(&Golden{Entries: []*Entry{
+		{Kind: "exec", Query: "UPDATE t SET a = ?", Args: []Value{{int64(1)}}, RowsAffected: 1},
+		{Kind: "query", Query: "SELECT a FROM t", Columns: []string{"a"}},
+	}})
+	d := sql.OpenDB(rp)
+	defer d.Close()
+	ctx := context.Background()
+
+	if _, err := d.ExecContext(ctx, "UPDATE t SET a = ?", 2); !errors.Is(err, ErrUnexpectedQuery) {
+		t.Errorf("mismatched args: err = %v", err)
+	}
+	if _, err := d.ExecContext(ctx, "DELETE FROM t"); !errors.Is(err, ErrUnexpectedQuery) {
+		t.Errorf("unrecorded query: err = %v", err)
+	}
+	// 同一条记录只能回放一次
+	if _, err := d.ExecContext(ctx, "UPDATE t SET a = ?", 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.ExecContext(ctx, "UPDATE t SET a = ?", 1); !errors.Is(err, ErrUnexpectedQuery) {
+		t.Errorf("replayed twice: err = %v", err)
+	}
+
+	err := rp.Done()
+	if err == nil || !strings.Contains(err.Error(), "1 entries not replayed") || !strings.Contains(err.Error(), "SELECT a FROM t") {
+		t.Errorf("Done = %v", err)
+	}
+	if remaining := rp.Remaining(); len(remaining) != 1 || remaining[0].Kind != "query" {
+		t.Errorf("Remaining = %v", remaining)
+	}
+}
+
+func TestValueJSON(t *testing.T) {
+	values := []Value{{nil}, {int64(-1)}, {uint64(1 << 63)}, {1.5}, {true}, {"s"}, {[]byte{0, 1}}, {fakeTime}}
+	for _, v := range values {
+		data, err := v.MarshalJSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got Value
+		if err := got.UnmarshalJSON(data); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, v) {
+			t.Errorf("%s: got %#v, want %#v", data, got.V, v.V)
+		}
+	}
+
+	if _, err := (Value{struct{}{}}).MarshalJSON(); err == nil {
+		t.Error("unsupported type: no error")
+	}
+	var v Value
+	if err := v.UnmarshalJSON([]byte(`{"type":"decimal","value":"1"}`)); err == nil {
+		t.Error("unknown type: no error")
+	}
+}
@@ -0,0 +1,59 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+
+	"github.com/aiyi/go/db/replay"
+	"github.com/jmoiron/sqlx"
+)
+
+// TestReplayRoundTrip 通过 Handle 录制 fakedb 上执行的语句, 然后回放同样的操作.
+func TestReplayRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	run := func(h *Handle) error {
+		name := "bob"
+		if _, err := h.Update(ctx, "users", &userPatch{Name: &name}, new(Filter).Where("id = ?", 1)); err != nil {
+			return err
+		}
+		var ids []int64
+		if err := h.SelectContext(ctx, &ids, "SELECT id FROM users WHERE name = ?", name); err != nil {
+			return err
+		}
+		return h.WithTx(ctx, nil, func(tx *Tx) error {
+			_, err := tx.ExecContext(ctx, "DELETE FROM users WHERE id = ?", 1)
+			return err
+		})
+	}
+
+	rec, err := replay.NewRecorder("fakedb", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	recDB := sql.OpenDB(rec)
+	defer recDB.Close()
+	h := newHandle("test")
+	h.SetDB(sqlx.NewDb(recDB, "mysql"))
+	if err := run(h); err != nil {
+		t.Fatal(err)
+	}
+
+	rp := replay.NewReplayer(rec.Golden())
+	rpDB := sql.OpenDB(rp)
+	defer rpDB.Close()
+	h.SetDB(sqlx.NewDb(rpDB, "mysql"))
+	if err := run(h); err != nil {
+		t.Fatal(err)
+	}
+	if err := rp.Done(); err != nil {
+		t.Error(err)
+	}
+
+	// 参数不同的语句没有录制过
+	name := "alice"
+	if _, err := h.Update(ctx, "users", &userPatch{Name: &name}, new(Filter).Where("id = ?", 1)); !errors.Is(err, replay.ErrUnexpectedQuery) {
+		t.Errorf("err = %v, want ErrUnexpectedQuery", err)
+	}
+}
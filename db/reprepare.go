@@ -0,0 +1,59 @@
+package db
+
+import (
+	"strings"
+	"sync"
+)
+
+// StmtInvalidator 判断 err 是否表示缓存的 Stmt 已经失效, 需要重新创建.
+// 比如主从切换或者修改表结构之后, MySQL 返回 "Prepared statement needs to be re-prepared".
+type StmtInvalidator func(err error) bool
+
+var (
+	invalidatorsRWMutex sync.RWMutex
+	invalidators        = map[string][]StmtInvalidator{ // map[driverName][]StmtInvalidator
+		"mysql":    {mysqlStmtInvalid},
+		"postgres": {postgresStmtInvalid},
+		"pgx":      {postgresStmtInvalid},
+	}
+)
+
+// RegisterStmtInvalidator 为 driverName 增加一个 StmtInvalidator, driverName 同 sqlx.DB.DriverName().
+//
+// 使用缓存的 Stmt 执行语句返回的错误被判断为 Stmt 失效时, 会从缓存中删除该 Stmt, 重新创建并重试一次.
+func RegisterStmtInvalidator(driverName string, fn StmtInvalidator) {
+	invalidatorsRWMutex.Lock()
+	defer invalidatorsRWMutex.Unlock()
+	invalidators[driverName] = append(invalidators[driverName], fn)
+}
+
+func isStmtInvalid(driverName string, err error) bool {
+	if err == nil {
+		return false
+	}
+
+	invalidatorsRWMutex.RLock()
+	defer invalidatorsRWMutex.RUnlock()
+
+	for _, fn := range invalidators[driverName] {
+		if fn(err) {
+			return true
+		}
+	}
+	return false
+}
+
+func mysqlStmtInvalid(err error) bool {
+	switch number, _ := mysqlErrorNumber(err); number {
+	case 1243, // ER_UNKNOWN_STMT_HANDLER
+		1615: // ER_NEED_REPREPARE
+		return true
+	}
+	return false
+}
+
+func postgresStmtInvalid(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "cached plan must not change result type") ||
+		strings.Contains(msg, "prepared statement") && strings.Contains(msg, "does not exist")
+}
@@ -0,0 +1,167 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// MySQLError 模拟 github.com/go-sql-driver/mysql 的 *mysql.MySQLError, mysqlErrorNumber 按照类型名识别.
+type MySQLError struct {
+	Number  uint16
+	Message string
+}
+
+func (e *MySQLError) Error() string {
+	return fmt.Sprintf("Error %d: %s", e.Number, e.Message)
+}
+
+// failExec 返回的 fail 函数让 query 的前 n 次 exec 返回 err, n < 0 时总是返回 err.
+func failExec(query string, n int, err error) func(op, q string) error {
+	return func(op, q string) error {
+		if op != "exec" || q != query || n == 0 {
+			return nil
+		}
+		n--
+		return err
+	}
+}
+
+func TestStmtInvalid(t *testing.T) {
+	tests := []struct {
+		driverName string
+		err        error
+		want       bool
+	}{
+		{"mysql", &MySQLError{1243, "Unknown prepared statement handler"}, true},
+		{"mysql", fmt.Errorf("exec: %w", &MySQLError{1615, "Prepared statement needs to be re-prepared"}), true},
+		{"mysql", &MySQLError{1062, "Duplicate entry"}, false},
+		{"mysql", errors.New("prepared statement needs to be re-prepared"), false},
+		{"postgres", errors.New("pq: cached plan must not change result type"), true},
+		{"pgx", errors.New(`ERROR: prepared statement "stmtcache_1" does not exist (SQLSTATE 26000)`), true},
+		{"postgres", errors.New(`pq: relation "t" does not exist`), false},
+		{"postgres", &MySQLError{1615, "Prepared statement needs to be re-prepared"}, false},
+		{"sqlite3", errors.New("pq: cached plan must not change result type"), false},
+		{"mysql", nil, false},
+	}
+	for _, tt := range tests {
+		if got := isStmtInvalid(tt.driverName, tt.err); got != tt.want {
+			t.Errorf("isStmtInvalid(%q, %v) = %v, want %v", tt.driverName, tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestReprepareInvalidStmt(t *testing.T) {
+	d, fake := newFakeDB(t)
+	h := Use("test-reprepare")
+	h.SetDB(d)
+	defer h.CloseDB()
+
+	ctx := context.Background()
+	const query = "UPDATE t SET a=?"
+	if _, err := h.ExecContext(ctx, query, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// 缓存的 Stmt 开始返回失效的错误, 比如表结构被修改
+	fake.setFail(failExec(query, 1, &MySQLError{1615, "Prepared statement needs to be re-prepared"}))
+	if _, err := h.ExecContext(ctx, query, 2); err != nil {
+		t.Fatalf("ExecContext: %v", err)
+	}
+	if n := fake.count("prepare " + query); n != 2 {
+		t.Errorf("prepared %d times, want 2", n)
+	}
+	if n := fake.count("close " + query); n != 1 {
+		t.Errorf("invalid stmt closed %d times, want 1", n)
+	}
+	if n := fake.count("exec " + query); n != 3 {
+		t.Errorf("executed %d times, want 3", n)
+	}
+
+	// 重新创建的 Stmt 留在缓存中
+	if _, err := h.ExecContext(ctx, query, 3); err != nil {
+		t.Fatal(err)
+	}
+	if n := fake.count("prepare " + query); n != 2 {
+		t.Errorf("prepared %d times after re-prepare, want 2", n)
+	}
+}
+
+func TestReprepareOnce(t *testing.T) {
+	sqlDB, fake := newFakeDB(t)
+	h := Use("test-reprepare-once")
+	h.SetDB(sqlx.NewDb(sqlDB.DB, "postgres"))
+	defer h.CloseDB()
+
+	ctx := context.Background()
+	const query = "UPDATE t SET a=$1"
+	errInvalid := errors.New(`pq: prepared statement "1" does not exist`)
+	fake.setFail(failExec(query, -1, errInvalid))
+
+	if _, err := h.ExecContext(ctx, query, 1); !errors.Is(err, errInvalid) {
+		t.Fatalf("err = %v, want %v", err, errInvalid)
+	}
+	if n := fake.count("exec " + query); n != 2 {
+		t.Errorf("executed %d times, want 2", n)
+	}
+	if n := fake.count("prepare " + query); n != 2 {
+		t.Errorf("prepared %d times, want 2", n)
+	}
+}
+
+func TestReprepareNamedStmt(t *testing.T) {
+	d, fake := newFakeDB(t)
+	h := Use("test-reprepare-named")
+	h.SetDB(d)
+	defer h.CloseDB()
+
+	ctx := context.Background()
+	arg := map[string]interface{}{"a": 1}
+	if _, err := h.NamedExecContext(ctx, "UPDATE t SET a=:a", arg); err != nil {
+		t.Fatal(err)
+	}
+
+	const query = "UPDATE t SET a=?"
+	fake.setFail(failExec(query, 1, &MySQLError{1243, "Unknown prepared statement handler"}))
+	if _, err := h.NamedExecContext(ctx, "UPDATE t SET a=:a", arg); err != nil {
+		t.Fatalf("NamedExecContext: %v", err)
+	}
+	if n := fake.count("prepare " + query); n != 2 {
+		t.Errorf("prepared %d times, want 2", n)
+	}
+}
+
+func TestRegisterStmtInvalidator(t *testing.T) {
+	fake := &fakeDriver{}
+	sqlDB := sql.OpenDB(fake)
+	defer sqlDB.Close()
+
+	h := Use("test-reprepare-register")
+	h.SetDB(sqlx.NewDb(sqlDB, "fakeinvalid"))
+	defer h.CloseDB()
+
+	ctx := context.Background()
+	const query = "DELETE FROM t"
+	errSchema := errors.New("fake: schema changed")
+	fake.setFail(failExec(query, 1, errSchema))
+
+	// 没有注册时错误直接返回, 不会重新创建
+	if _, err := h.ExecContext(ctx, query); !errors.Is(err, errSchema) {
+		t.Fatalf("err = %v, want %v", err, errSchema)
+	}
+
+	RegisterStmtInvalidator("fakeinvalid", func(err error) bool {
+		return errors.Is(err, errSchema)
+	})
+	fake.setFail(failExec(query, 1, errSchema))
+	if _, err := h.ExecContext(ctx, query); err != nil {
+		t.Fatalf("ExecContext: %v", err)
+	}
+	if n := fake.count("prepare " + query); n != 2 {
+		t.Errorf("prepared %d times, want 2", n)
+	}
+}
@@ -0,0 +1,170 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// RetryPolicy 是遇到临时性错误时的重试策略, 使用带随机抖动的指数退避.
+//
+// 重试只作用于只读的 SELECT 和 WithTxRetry 的整个事务, 不会重试事务之外的写语句.
+type RetryPolicy struct {
+	MaxAttempts int           // 最多执行的次数, 包括第一次; <= 1 表示不重试
+	BaseDelay   time.Duration // 第一次重试前的等待时间
+	MaxDelay    time.Duration // 等待时间的上限, <= 0 表示不限制
+	Multiplier  float64       // 每次重试等待时间的倍数, < 1 时使用 2
+	Jitter      float64       // 等待时间随机减少的最大比例, 取值 [0, 1]
+}
+
+// DefaultRetryPolicy 是推荐的重试策略, 需要通过 SetRetryPolicy 启用.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 3,
+	BaseDelay:   time.Millisecond * 20,
+	MaxDelay:    time.Second,
+	Multiplier:  2,
+	Jitter:      0.5,
+}
+
+// backoff 返回第 attempt 次重试(从 1 开始)之前的等待时间.
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = 2
+	}
+	delay := float64(p.BaseDelay)
+	for i := 1; i < attempt; i++ {
+		delay *= multiplier
+		if p.MaxDelay > 0 && delay >= float64(p.MaxDelay) {
+			break
+		}
+	}
+	if p.MaxDelay > 0 && delay > float64(p.MaxDelay) {
+		delay = float64(p.MaxDelay)
+	}
+	if p.Jitter > 0 {
+		delay -= delay * p.Jitter * rand.Float64()
+	}
+	return time.Duration(delay)
+}
+
+// do 执行 fn, 返回可以重试的错误时按照策略等待并重试, ctx 结束时返回最后一次的错误.
+func (p *RetryPolicy) do(ctx context.Context, fn func() error) (err error) {
+	for attempt := 1; ; attempt++ {
+		if err = fn(); err == nil || attempt >= p.MaxAttempts || !IsRetryable(err) {
+			return
+		}
+
+		timer := time.NewTimer(p.backoff(attempt))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// RetryClassifier 判断 err 是否是可以重试的临时性错误.
+type RetryClassifier func(err error) bool
+
+var (
+	// RetryableMySQLErrors 是可以重试的 MySQL 错误码.
+	RetryableMySQLErrors = map[uint16]bool{
+		1205: true, // ER_LOCK_WAIT_TIMEOUT
+		1213: true, // ER_LOCK_DEADLOCK
+	}
+
+	// RetryablePostgresErrors 是可以重试的 Postgres SQLSTATE.
+	RetryablePostgresErrors = map[string]bool{
+		"40001": true, // serialization_failure
+		"40P01": true, // deadlock_detected
+		"55P03": true, // lock_not_available
+	}
+
+	classifiersRWMutex sync.RWMutex
+	classifiers        []RetryClassifier
+)
+
+// RegisterRetryable 增加一个 RetryClassifier, 用于 RetryableMySQLErrors 和 RetryablePostgresErrors 之外的错误.
+func RegisterRetryable(fn RetryClassifier) {
+	classifiersRWMutex.Lock()
+	defer classifiersRWMutex.Unlock()
+	classifiers = append(classifiers, fn)
+}
+
+// IsRetryable 判断 err 是否是可以重试的临时性错误.
+// context 结束和 sql.ErrNoRows 等错误不会重试.
+func IsRetryable(err error) bool {
+	if err == nil || isContextError(err) || errors.Is(err, sql.ErrNoRows) || errors.Is(err, sql.ErrTxDone) {
+		return false
+	}
+	if errors.Is(err, driver.ErrBadConn) {
+		return true
+	}
+	if number, ok := mysqlErrorNumber(err); ok {
+		return RetryableMySQLErrors[number]
+	}
+	if code, ok := postgresErrorCode(err); ok {
+		return RetryablePostgresErrors[code]
+	}
+
+	classifiersRWMutex.RLock()
+	defer classifiersRWMutex.RUnlock()
+
+	for _, fn := range classifiers {
+		if fn(err) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetRetryPolicy 设置只读 SELECT 的重试策略, nil 表示不重试(默认).
+// 只有 ExecContext, QueryContext, GetContext 等函数执行的只读 SELECT 会重试, 见 isReadQuery.
+func (h *Handle) SetRetryPolicy(p *RetryPolicy) {
+	h.retryRWMutex.Lock()
+	defer h.retryRWMutex.Unlock()
+	h.retryPolicy = p
+}
+
+func (h *Handle) getRetryPolicy() *RetryPolicy {
+	h.retryRWMutex.RLock()
+	defer h.retryRWMutex.RUnlock()
+	return h.retryPolicy
+}
+
+// retry 对只读的 query 按照重试策略执行 fn, 其他 query 只执行一次.
+func (h *Handle) retry(ctx context.Context, query string, fn func() error) error {
+	p := h.getRetryPolicy()
+	if p == nil || !isReadQuery(h.primaryNode().driverName(), query) {
+		return fn()
+	}
+	return p.do(ctx, fn)
+}
+
+// WithTxRetry 同 WithTx, 但是事务因为死锁等临时性错误失败时, 按照 p 重新执行整个事务.
+// fn 可能被执行多次, 不能有数据库之外的副作用. p 为 nil 时使用 SetRetryPolicy 设置的策略,
+// 都没有设置时使用 DefaultRetryPolicy.
+func (h *Handle) WithTxRetry(ctx context.Context, opts *sql.TxOptions, p *RetryPolicy, fn func(tx *Tx) error) error {
+	if p == nil {
+		if p = h.getRetryPolicy(); p == nil {
+			p = &DefaultRetryPolicy
+		}
+	}
+	return p.do(ctx, func() error {
+		return h.WithTx(ctx, opts, fn)
+	})
+}
+
+func SetRetryPolicy(p *RetryPolicy) {
+	defaultHandle.SetRetryPolicy(p)
+}
+
+func WithTxRetry(ctx context.Context, opts *sql.TxOptions, p *RetryPolicy, fn func(tx *Tx) error) error {
+	return defaultHandle.WithTxRetry(ctx, opts, p, fn)
+}
@@ -0,0 +1,147 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+var testRetryPolicy = &RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond}
+
+func TestWithTxRetry(t *testing.T) {
+	d, fake := newFakeDB(t)
+	h := newHandle("test")
+	h.SetDB(d)
+
+	// 死锁时重新执行整个事务
+	calls := 0
+	err := h.WithTxRetry(context.Background(), nil, testRetryPolicy, func(tx *Tx) error {
+		calls++
+		if _, err := tx.Exec("UPDATE t SET a=1"); err != nil {
+			return err
+		}
+		if calls == 1 {
+			return &MySQLError{1213, "Deadlock found when trying to get lock"}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Errorf("fn called %d times, want 2", calls)
+	}
+	if b, r, c := fake.count("begin"), fake.count("rollback"), fake.count("commit"); b != 2 || r != 1 || c != 1 {
+		t.Errorf("begin %d, rollback %d, commit %d times, want 2, 1, 1", b, r, c)
+	}
+	if n := fake.count("exec UPDATE t SET a=1"); n != 2 {
+		t.Errorf("executed %d times, want 2", n)
+	}
+}
+
+func TestWithTxRetryCommit(t *testing.T) {
+	d, fake := newFakeDB(t)
+	h := newHandle("test")
+	h.SetDB(d)
+
+	// 提交失败的临时性错误同样重新执行事务
+	failed := false
+	fake.setFail(func(op, query string) error {
+		if op == "commit" && !failed {
+			failed = true
+			return errTransient
+		}
+		return nil
+	})
+	calls := 0
+	err := h.WithTxRetry(context.Background(), nil, testRetryPolicy, func(tx *Tx) error {
+		calls++
+		return nil
+	})
+	if err != nil || calls != 2 {
+		t.Errorf("err = %v, fn called %d times, want 2", err, calls)
+	}
+}
+
+func TestWithTxRetryNotRetryable(t *testing.T) {
+	d, fake := newFakeDB(t)
+	h := newHandle("test")
+	h.SetDB(d)
+
+	for _, errFn := range []error{
+		errors.New("duplicate key"),
+		&MySQLError{1062, "Duplicate entry"},
+		context.Canceled,
+	} {
+		calls := 0
+		err := h.WithTxRetry(context.Background(), nil, testRetryPolicy, func(tx *Tx) error {
+			calls++
+			return errFn
+		})
+		if err != errFn || calls != 1 {
+			t.Errorf("%v: err = %v, fn called %d times, want 1", errFn, err, calls)
+		}
+	}
+	if n := fake.count("begin"); n != 3 {
+		t.Errorf("begin %d times, want 3", n)
+	}
+}
+
+func TestWithTxRetryAttempts(t *testing.T) {
+	d, fake := newFakeDB(t)
+	h := newHandle("test")
+	h.SetDB(d)
+
+	tests := []struct {
+		policy *RetryPolicy // 为 nil 时使用句柄的策略
+		handle *RetryPolicy
+		want   int
+	}{
+		{testRetryPolicy, nil, 3},
+		{&RetryPolicy{MaxAttempts: 1}, nil, 1},
+		{&RetryPolicy{}, nil, 1},
+		{nil, &RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond}, 2},
+		{nil, nil, DefaultRetryPolicy.MaxAttempts},
+	}
+	for _, tt := range tests {
+		h.SetRetryPolicy(tt.handle)
+		begins := fake.count("begin")
+		calls := 0
+		err := h.WithTxRetry(context.Background(), nil, tt.policy, func(tx *Tx) error {
+			calls++
+			return errTransient
+		})
+		if err != errTransient {
+			t.Errorf("err = %v, want %v", err, errTransient)
+		}
+		if calls != tt.want {
+			t.Errorf("policy %+v, handle policy %+v: fn called %d times, want %d", tt.policy, tt.handle, calls, tt.want)
+		}
+		if n := fake.count("begin") - begins; n != tt.want {
+			t.Errorf("begin %d times, want %d", n, tt.want)
+		}
+	}
+}
+
+func TestWithTxRetryContext(t *testing.T) {
+	d, _ := newFakeDB(t)
+	h := newHandle("test")
+	h.SetDB(d)
+
+	// ctx 结束时停止等待, 返回最后一次的错误
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	calls := 0
+	start := time.Now()
+	err := h.WithTxRetry(ctx, nil, &RetryPolicy{MaxAttempts: 10, BaseDelay: time.Hour}, func(tx *Tx) error {
+		calls++
+		return errTransient
+	})
+	if err != errTransient || calls != 1 {
+		t.Errorf("err = %v, fn called %d times", err, calls)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("retry did not stop when ctx is done: %v", elapsed)
+	}
+}
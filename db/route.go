@@ -0,0 +1,133 @@
+package db
+
+import (
+	"context"
+	"strings"
+
+	"github.com/aiyi/go/db/internal/sqllex"
+)
+
+// Balance 是在多个从库之间选择的策略.
+type Balance int
+
+const (
+	RoundRobin    Balance = iota // 轮流使用每个从库
+	LeastInFlight                // 使用正在使用的连接数最少的从库
+)
+
+type primaryKey struct{}
+
+// WithPrimary 返回一个强制使用主库的 context, 用于写后立即读(read-your-writes)的场景.
+//
+//	ctx = db.WithPrimary(ctx)
+//	stmt, err := db.GetStmtContext(ctx, "SELECT ...") // 在主库上执行
+func WithPrimary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryKey{}, true)
+}
+
+// IsPrimary 返回 ctx 是否被 WithPrimary 强制使用主库.
+func IsPrimary(ctx context.Context) bool {
+	forced, _ := ctx.Value(primaryKey{}).(bool)
+	return forced
+}
+
+// PrimaryFunctions 是只能在主库上执行的函数, 调用了这些函数的 SELECT 不会路由到从库, 也不会重试.
+// 它们读取或者修改连接或主库上的状态, 比如自增 ID, 序列和锁. 键是小写的函数名, 只能在初始化时修改.
+var PrimaryFunctions = map[string]bool{
+	// MySQL
+	"last_insert_id":    true,
+	"found_rows":        true,
+	"row_count":         true,
+	"get_lock":          true,
+	"release_lock":      true,
+	"release_all_locks": true,
+	"is_free_lock":      true,
+	"is_used_lock":      true,
+	"sleep":             true,
+	// PostgreSQL
+	"nextval":                      true,
+	"setval":                       true,
+	"currval":                      true,
+	"lastval":                      true,
+	"pg_advisory_lock":             true,
+	"pg_advisory_lock_shared":      true,
+	"pg_advisory_xact_lock":        true,
+	"pg_advisory_unlock":           true,
+	"pg_advisory_unlock_all":       true,
+	"pg_try_advisory_lock":         true,
+	"pg_try_advisory_xact_lock":    true,
+	"pg_advisory_xact_lock_shared": true,
+}
+
+// isReadQuery 判断 query 是否是可以在从库上执行, 失败时可以重试的只读语句.
+// 以下 SELECT 只能在主库上执行:
+// 加锁的 FOR UPDATE, FOR SHARE, FOR NO KEY UPDATE, FOR KEY SHARE 和 LOCK IN SHARE MODE,
+// 写入表或变量的 SELECT ... INTO, 以及调用了 PrimaryFunctions 中的函数的语句.
+// driverName 决定字符串中的反斜杠是否是转义字符, 见 queryTokens.
+func isReadQuery(driverName, query string) bool {
+	tokens := queryTokens(driverName, query)
+	if len(tokens) == 0 || tokens[0] != "SELECT" {
+		return false
+	}
+	for i, tok := range tokens {
+		next := tokens[i+1:]
+		switch {
+		case tok == "INTO":
+			return false
+		case tok == "FOR":
+			if hasTokens(next, "UPDATE") || hasTokens(next, "SHARE") ||
+				hasTokens(next, "NO", "KEY", "UPDATE") || hasTokens(next, "KEY", "SHARE") {
+				return false
+			}
+		case tok == "LOCK":
+			if hasTokens(next, "IN", "SHARE", "MODE") {
+				return false
+			}
+		case hasTokens(next, "(") && PrimaryFunctions[strings.ToLower(tok)]:
+			return false
+		}
+	}
+	return true
+}
+
+func hasTokens(tokens []string, want ...string) bool {
+	if len(tokens) < len(want) {
+		return false
+	}
+	for i, w := range want {
+		if tokens[i] != w {
+			return false
+		}
+	}
+	return true
+}
+
+// queryTokens 把 query 分成大写的单词和 "(", 忽略空白, 注释, 引号中的字符串和标识符以及其他符号.
+// schema.func 这样的限定名分成两个单词. 字符串和注释的词法随驱动不同, 见 sqllex.MySQL.
+func queryTokens(driverName, query string) []string {
+	mysql := sqllex.MySQL(driverName)
+	var tokens []string
+	for i := 0; i < len(query); {
+		if end := sqllex.SkipComment(query, i, mysql); end > i {
+			i = end
+			continue
+		}
+		c := query[i]
+		switch {
+		case sqllex.IsIdentByte(c):
+			start := i
+			for i < len(query) && sqllex.IsIdentByte(query[i]) {
+				i++
+			}
+			tokens = append(tokens, strings.ToUpper(query[start:i]))
+		case c == '(':
+			tokens = append(tokens, "(")
+			i++
+		case c == '\'' || c == '"' || c == '`':
+			i = sqllex.SkipQuoted(query, i, c, mysql)
+		default:
+			i++
+		}
+	}
+	return tokens
+}
@@ -0,0 +1,110 @@
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestIsReadQuery(t *testing.T) {
+	tests := []struct {
+		driverName string
+		query      string
+		read       bool
+	}{
+		{"mysql", "SELECT * FROM t", true},
+		{"mysql", "  /* hint */ select * from t", true},
+		{"mysql", "-- comment\nSELECT 1", true},
+		{"mysql", "SELECT * FROM t WHERE name = 'for update'", true},
+		{"mysql", "SELECT `for`, `update` FROM t", true},
+		{"mysql", "SELECT next_val(1), sleepy FROM t", true},
+		{"mysql", "UPDATE t SET a=1", false},
+		{"mysql", "INSERT INTO t SELECT * FROM s", false},
+		{"mysql", "SELECT * FROM t FOR UPDATE", false},
+		{"mysql", "SELECT * FROM t\nFOR UPDATE", false},
+		{"mysql", "SELECT * FROM t\tfor\tupdate", false},
+		{"mysql", "SELECT * FROM t WHERE id=1 FOR SHARE", false},
+		{"mysql", "SELECT * FROM t\nLOCK IN SHARE MODE", false},
+		{"mysql", "SELECT * FROM t /* x */ FOR /* y */ UPDATE", false},
+		{"mysql", "SELECT * FROM t INTO OUTFILE '/tmp/t'", false},
+		{"mysql", "SELECT LAST_INSERT_ID()", false},
+		{"mysql", "SELECT last_insert_id ()", false},
+		{"mysql", "SELECT GET_LOCK('name', 10)", false},
+		{"mysql", "SELECT * FROM t WHERE name = 'it\\'s' FOR UPDATE", false},
+		{"postgres", "SELECT * FROM t FOR NO KEY UPDATE", false},
+		{"postgres", "SELECT * FROM t FOR KEY SHARE", false},
+		{"postgres", "SELECT nextval('seq')", false},
+		{"postgres", "SELECT pg_catalog.setval('seq', 1)", false},
+		{"postgres", "SELECT pg_try_advisory_lock(1)", false},
+		{"postgres", "SELECT * INTO backup FROM t", false},
+		{"postgres", "SELECT * FROM t WHERE path = 'C:\\' FOR UPDATE", false},
+		{"postgres", "SELECT a # b FROM t FOR UPDATE", false},
+	}
+	for _, tt := range tests {
+		if read := isReadQuery(tt.driverName, tt.query); read != tt.read {
+			t.Errorf("isReadQuery(%q, %q) = %v, want %v", tt.driverName, tt.query, read, tt.read)
+		}
+	}
+}
+
+func TestRoute(t *testing.T) {
+	primary, dp := newFakeDB(t)
+	replica, dr := newFakeDB(t)
+	h := newHandle("test")
+	h.SetDB(primary)
+	h.SetReplicas(replica)
+
+	ctx := context.Background()
+	queries := map[string]*fakeDriver{
+		"SELECT * FROM t":             dr,
+		"SELECT * FROM t\nFOR UPDATE": dp,
+		"SELECT * FROM t\tFOR SHARE":  dp,
+		"SELECT LAST_INSERT_ID()":     dp,
+		"UPDATE t SET a=1":            dp,
+	}
+	for query, want := range queries {
+		if _, err := h.ExecContext(ctx, query); err != nil {
+			t.Fatal(err)
+		}
+		if want.count("exec "+query) != 1 {
+			t.Errorf("%q is not executed on the expected node", query)
+		}
+	}
+
+	if _, err := h.ExecContext(WithPrimary(ctx), "SELECT 1"); err != nil {
+		t.Fatal(err)
+	}
+	if dp.count("exec SELECT 1") != 1 {
+		t.Error("WithPrimary is not executed on the primary")
+	}
+}
+
+func TestRetryOnlyReadQueries(t *testing.T) {
+	d, fd := newFakeDB(t)
+	h := newHandle("test")
+	h.SetDB(d)
+	h.SetRetryPolicy(&RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond})
+	fd.setFail(func(op, query string) error {
+		if op == "exec" {
+			return errTransient
+		}
+		return nil
+	})
+
+	ctx := context.Background()
+	queries := map[string]int{
+		"SELECT * FROM t":                   3,
+		"SELECT * FROM t\nFOR UPDATE":       1,
+		"SELECT * FROM t FOR NO KEY UPDATE": 1,
+		"SELECT nextval('seq')":             1,
+		"UPDATE t SET a=1":                  1,
+	}
+	for query, attempts := range queries {
+		if _, err := h.ExecContext(ctx, query); err != errTransient {
+			t.Fatalf("%q: err = %v", query, err)
+		}
+		if n := fd.count("exec " + query); n != attempts {
+			t.Errorf("%q executed %d times, want %d", query, n, attempts)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package db
+
+import (
+	"context"
+	"errors"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// ErrShutdown 表示句柄正在关闭或者已经关闭, 不再接受新的数据库操作.
+var ErrShutdown = errors.New("db: handle is shut down")
+
+// enter 登记一个正在进行的数据库操作, 结束时必须调用 leave; 句柄正在关闭时返回 ErrShutdown.
+func (h *Handle) enter() error {
+	h.drainMutex.Lock()
+	defer h.drainMutex.Unlock()
+
+	if h.drained != nil {
+		return ErrShutdown
+	}
+	h.inflight++
+	return nil
+}
+
+func (h *Handle) leave() {
+	h.drainMutex.Lock()
+	defer h.drainMutex.Unlock()
+
+	h.inflight--
+	if h.inflight == 0 && h.drained != nil {
+		close(h.drained)
+	}
+}
+
+// drain 停止接受新的数据库操作, 返回所有正在进行的操作结束时关闭的 channel.
+func (h *Handle) drain() <-chan struct{} {
+	h.drainMutex.Lock()
+	defer h.drainMutex.Unlock()
+
+	if h.drained == nil {
+		h.drained = make(chan struct{})
+		if h.inflight == 0 {
+			close(h.drained)
+		}
+	}
+	return h.drained
+}
+
+// reopen 在 SetDB 设置新的数据库之后重新接受数据库操作.
+func (h *Handle) reopen() {
+	h.drainMutex.Lock()
+	defer h.drainMutex.Unlock()
+	h.drained = nil
+}
+
+// InFlight 返回正在进行的数据库操作的数量.
+func (h *Handle) InFlight() int {
+	h.drainMutex.Lock()
+	defer h.drainMutex.Unlock()
+	return h.inflight
+}
+
+// AcquireStmt 同 GetStmtContext, 但是把 Stmt 的使用登记为正在进行的操作, 使用完之后必须调用 release.
+// 直接使用 GetStmt 返回的 Stmt 时 Shutdown 无法知道它是否还在使用;
+// AcquireStmt 返回的 Stmt 在 release 之前被淘汰也不会关闭.
+//
+//	stmt, release, err := db.AcquireStmt(ctx, query)
+//	if err != nil {
+//		return err
+//	}
+//	defer release()
+func (h *Handle) AcquireStmt(ctx context.Context, query string) (stmt *sqlx.Stmt, release func(), err error) {
+	if err = h.enter(); err != nil {
+		return
+	}
+	stmt, releaseStmt, err := h.route(ctx, query).acquireStmt(ctx, query, h.guard)
+	if err != nil {
+		h.leave()
+		return
+	}
+	return stmt, func() {
+		releaseStmt()
+		h.leave()
+	}, nil
+}
+
+// AcquireNamedStmt 同 AcquireStmt, 返回 NamedStmt.
+func (h *Handle) AcquireNamedStmt(ctx context.Context, query string) (stmt *sqlx.NamedStmt, release func(), err error) {
+	if err = h.enter(); err != nil {
+		return
+	}
+	stmt, releaseStmt, err := h.route(ctx, query).acquireNamedStmt(ctx, query, h.guard)
+	if err != nil {
+		h.leave()
+		return
+	}
+	return stmt, func() {
+		releaseStmt()
+		h.leave()
+	}, nil
+}
+
+// Shutdown 优雅地关闭句柄:
+// 停止接受新的数据库操作(返回 ErrShutdown), 等待正在进行的操作结束, 最多等到 ctx 结束,
+// 然后停止 Cleaner, 关闭所有缓存的 Stmt, 最后关闭主库和从库的连接.
+//
+// 正在进行的操作包括 ExecContext 等函数, WithTx 的整个事务和 AcquireStmt 到 release 之间;
+// QueryContext 返回的 Rows 在返回之后不再计入.
+// ctx 结束时仍然会关闭所有资源, 并返回 ctx.Err().
+func (h *Handle) Shutdown(ctx context.Context) (err error) {
+	select {
+	case <-h.drain():
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	h.StopCleaner()
+	h.CloseAllStmt()
+	if e := h.CloseDB(); e != nil && err == nil {
+		err = e
+	}
+	return
+}
+
+func AcquireStmt(ctx context.Context, query string) (*sqlx.Stmt, func(), error) {
+	return defaultHandle.AcquireStmt(ctx, query)
+}
+
+func AcquireNamedStmt(ctx context.Context, query string) (*sqlx.NamedStmt, func(), error) {
+	return defaultHandle.AcquireNamedStmt(ctx, query)
+}
+
+// Shutdown 优雅地关闭默认句柄, 见 Handle.Shutdown.
+func Shutdown(ctx context.Context) error {
+	return defaultHandle.Shutdown(ctx)
+}
+
+// ShutdownAll 并发地关闭所有设置了数据库的句柄, 返回第一个错误.
+func ShutdownAll(ctx context.Context) error {
+	var hs []*Handle
+	for _, h := range Handles() {
+		if h.GetDB() != nil {
+			hs = append(hs, h)
+		}
+	}
+
+	errs := make(chan error, len(hs))
+	for _, h := range hs {
+		go func(h *Handle) {
+			errs <- h.Shutdown(ctx)
+		}(h)
+	}
+
+	var err error
+	for range hs {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
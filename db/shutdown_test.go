@@ -0,0 +1,70 @@
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestShutdownWithoutDB(t *testing.T) {
+	h := newHandle("test")
+	h.StartCleaner(CleanerOptions{Interval: time.Hour})
+	if err := h.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if h.Cleaner() != nil {
+		t.Error("cleaner is not stopped")
+	}
+	if err := h.CloseDB(); err != nil {
+		t.Fatal(err)
+	}
+	if health := h.Health(context.Background()); health.OK {
+		t.Error("handle without a database is healthy")
+	}
+}
+
+func TestShutdownWaitsForAcquiredStmt(t *testing.T) {
+	d, _ := newFakeDB(t)
+	h := newHandle("test")
+	h.SetDB(d)
+
+	_, release, err := h.AcquireStmt(context.Background(), "UPDATE t SET a=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() {
+		done <- h.Shutdown(context.Background())
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("Shutdown returned while a stmt is acquired")
+	case <-time.After(20 * time.Millisecond):
+	}
+	if _, err = h.ExecContext(context.Background(), "UPDATE t SET a=1"); err != ErrShutdown {
+		t.Errorf("err = %v, want ErrShutdown", err)
+	}
+	release()
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	d, _ := newFakeDB(t)
+	h := newHandle("test")
+	h.SetDB(d)
+
+	_, release, err := h.AcquireStmt(context.Background(), "UPDATE t SET a=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err = h.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("err = %v, want context.DeadlineExceeded", err)
+	}
+}
@@ -0,0 +1,304 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aiyi/go/db/internal/sqllex"
+)
+
+var (
+	inListRegexp = regexp.MustCompile(`\bin \(\?(?:, \?)*\)`)
+	valuesRegexp = regexp.MustCompile(`\bvalues \([^()]*\)(?:, \([^()]*\))*`)
+)
+
+// Fingerprint 把 SQL 归一化, 用于把只有参数不同的语句归为一类:
+// 去掉注释, 统一空白, 关键字转成小写, 字符串和数字常量(包括负数)以及 $1 这样的占位符替换为 ?,
+// IN (?, ?, ...) 替换为 IN (?+), VALUES (...), (...) 替换为 VALUES (?+).
+// 双引号和反引号中的标识符保持不变. 字符串和注释的词法随驱动不同, 见 sqllex.MySQL.
+//
+//	Fingerprint("mysql", "SELECT * FROM t WHERE id IN (1, 2, 3) AND name='x'")
+//	// select * from t where id in (?+) and name = ?
+func Fingerprint(driverName, query string) string {
+	mysql := sqllex.MySQL(driverName)
+	var b strings.Builder
+	b.Grow(len(query))
+
+	var prev string
+	write := func(token string) {
+		// 逗号, 右括号和点之前, 左括号和点之后不加空格, 其他 token 之间用一个空格分隔.
+		if prev != "" && prev != "(" && prev != "." && token != "," && token != ")" && token != "." {
+			b.WriteByte(' ')
+		}
+		b.WriteString(token)
+		prev = token
+	}
+
+	for i := 0; i < len(query); {
+		if end := sqllex.SkipComment(query, i, mysql); end > i {
+			i = end
+			continue
+		}
+		c := query[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '\'':
+			i = sqllex.SkipQuoted(query, i, '\'', mysql)
+			write("?")
+		case c == '"' || c == '`':
+			end := sqllex.SkipQuoted(query, i, c, mysql)
+			write(query[i:end])
+			i = end
+		case c == '$' && i+1 < len(query) && sqllex.IsDigit(query[i+1]):
+			for i++; i < len(query) && sqllex.IsDigit(query[i]); i++ {
+			}
+			write("?")
+		case c == '-' && isNumberStart(query, i+1) && unaryContext(prev):
+			// 负数和正数归为一类: a=-1, a = -1 和 a=1 都是 a = ?
+			i++
+		case isNumberStart(query, i):
+			for i++; i < len(query) && (sqllex.IsIdentByte(query[i]) || query[i] == '.'); i++ {
+			}
+			write("?")
+		case sqllex.IsIdentByte(c):
+			start := i
+			for i++; i < len(query) && sqllex.IsIdentByte(query[i]); i++ {
+			}
+			write(strings.ToLower(query[start:i]))
+		case strings.IndexByte(operatorBytes, c) >= 0:
+			start := i
+			// 运算符之后的 - 是负号, 不属于这个运算符
+			for i++; i < len(query) && strings.IndexByte(operatorBytes, query[i]) >= 0 && !(query[i] == '-' && isNumberStart(query, i+1)); i++ {
+			}
+			write(query[start:i])
+		default:
+			write(query[i : i+1])
+			i++
+		}
+	}
+
+	fp := inListRegexp.ReplaceAllString(b.String(), "in (?+)")
+	return valuesRegexp.ReplaceAllString(fp, "values (?+)")
+}
+
+// isNumberStart 判断 query[i] 是否是数字常量的开始, 比如 1, 1.5, .5; t1.5 这样的标识符之后的点不算.
+func isNumberStart(query string, i int) bool {
+	if i >= len(query) {
+		return false
+	}
+	c := query[i]
+	return sqllex.IsDigit(c) || c == '.' && i+1 < len(query) && sqllex.IsDigit(query[i+1]) && (i == 0 || !sqllex.IsIdentByte(query[i-1]))
+}
+
+// unaryKeywords 是之后的 - 是负号的关键字, 其他单词之后的 - 是减号.
+var unaryKeywords = map[string]bool{
+	"select": true, "where": true, "and": true, "or": true, "not": true, "set": true,
+	"when": true, "then": true, "else": true, "between": true, "like": true, "by": true,
+	"return": true, "values": true, "in": true, "is": true,
+}
+
+// unaryContext 判断在 token prev 之后的 - 是否是负号: 在语句开始, 运算符, 左括号, 逗号和 unaryKeywords 之后.
+func unaryContext(prev string) bool {
+	switch {
+	case prev == "" || prev == "(" || prev == ",":
+		return true
+	case strings.IndexByte(operatorBytes, prev[0]) >= 0:
+		return true
+	}
+	return unaryKeywords[prev]
+}
+
+const operatorBytes = "<>=!|&+-*/%^~:#"
+
+// SlowLogOptions 设置 SlowLog 的阈值和容量, 零值字段使用默认值.
+type SlowLogOptions struct {
+	// Threshold 执行时间达到这个值的语句被记录, 默认 200 毫秒.
+	Threshold time.Duration
+
+	// MaxFingerprints 最多保存的 Fingerprint 数量, 超过后丢弃最久没有出现的, 默认 1000.
+	MaxFingerprints int
+
+	// Samples 每个 Fingerprint 保存最近多少次的执行时间用于计算分位数, 默认 256.
+	Samples int
+
+	// DriverName 是语句使用的驱动, 决定 Fingerprint 的词法; 通常和 Handle 的驱动相同.
+	DriverName string
+
+	// OnSlowQuery 记录每个慢查询时调用, 可以用来输出日志; 可以为 nil.
+	OnSlowQuery func(ctx context.Context, query string, dur time.Duration, err error)
+}
+
+// SlowQueryStats 是一类慢查询的汇总.
+type SlowQueryStats struct {
+	Fingerprint string    `json:"fingerprint"`
+	Example     string    `json:"example"` // 最近一次的原始语句
+	Count       int64     `json:"count"`
+	Errors      int64     `json:"errors"`
+	Total       Duration  `json:"total"`
+	P50         Duration  `json:"p50"`
+	P99         Duration  `json:"p99"`
+	Max         Duration  `json:"max"`
+	LastSeen    time.Time `json:"last_seen"`
+}
+
+type slowStat struct {
+	example  string
+	count    int64
+	errors   int64
+	total    time.Duration
+	max      time.Duration
+	samples  []time.Duration // 环形缓冲区
+	next     int
+	lastSeen time.Time
+}
+
+// SlowLog 按照 Fingerprint 汇总执行时间超过阈值的语句, 它实现了 Hook:
+//
+//	slowLog := db.NewSlowLog(db.SlowLogOptions{Threshold: time.Millisecond * 100})
+//	db.AddHook(slowLog)
+//	...
+//	slowLog.WriteJSON(w)
+type SlowLog struct {
+	opts SlowLogOptions
+
+	mutex sync.Mutex
+	stats map[string]*slowStat // map[fingerprint]*slowStat
+}
+
+func NewSlowLog(opts SlowLogOptions) *SlowLog {
+	if opts.Threshold <= 0 {
+		opts.Threshold = time.Millisecond * 200
+	}
+	if opts.MaxFingerprints <= 0 {
+		opts.MaxFingerprints = 1000
+	}
+	if opts.Samples <= 0 {
+		opts.Samples = 256
+	}
+	return &SlowLog{
+		opts:  opts,
+		stats: make(map[string]*slowStat),
+	}
+}
+
+func (l *SlowLog) BeforeQuery(ctx context.Context, query string, args []interface{}) context.Context {
+	return ctx
+}
+
+func (l *SlowLog) AfterQuery(ctx context.Context, query string, args []interface{}, dur time.Duration, err error) {
+	if dur < l.opts.Threshold {
+		return
+	}
+	l.Record(query, dur, err)
+	if l.opts.OnSlowQuery != nil {
+		l.opts.OnSlowQuery(ctx, query, dur, err)
+	}
+}
+
+// Record 记录一次慢查询, 不检查阈值; 用于记录没有经过 Hook 的语句.
+func (l *SlowLog) Record(query string, dur time.Duration, err error) {
+	fp := Fingerprint(l.opts.DriverName, query)
+	now := time.Now()
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	stat := l.stats[fp]
+	if stat == nil {
+		if len(l.stats) >= l.opts.MaxFingerprints {
+			l.evictOldest()
+		}
+		stat = &slowStat{samples: make([]time.Duration, 0, l.opts.Samples)}
+		l.stats[fp] = stat
+	}
+
+	stat.example = query
+	stat.count++
+	if err != nil {
+		stat.errors++
+	}
+	stat.total += dur
+	if dur > stat.max {
+		stat.max = dur
+	}
+	if len(stat.samples) < l.opts.Samples {
+		stat.samples = append(stat.samples, dur)
+	} else {
+		stat.samples[stat.next] = dur
+		stat.next = (stat.next + 1) % l.opts.Samples
+	}
+	stat.lastSeen = now
+}
+
+// evictOldest 删除最久没有出现的 Fingerprint, 调用者必须持有 l.mutex.
+func (l *SlowLog) evictOldest() {
+	var oldest string
+	var oldestTime time.Time
+	for fp, stat := range l.stats {
+		if oldest == "" || stat.lastSeen.Before(oldestTime) {
+			oldest, oldestTime = fp, stat.lastSeen
+		}
+	}
+	delete(l.stats, oldest)
+}
+
+// Snapshot 返回所有慢查询的汇总, 按照总耗时从大到小排列.
+func (l *SlowLog) Snapshot() []SlowQueryStats {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	result := make([]SlowQueryStats, 0, len(l.stats))
+	for fp, stat := range l.stats {
+		samples := make([]time.Duration, len(stat.samples))
+		copy(samples, stat.samples)
+		sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+
+		result = append(result, SlowQueryStats{
+			Fingerprint: fp,
+			Example:     stat.example,
+			Count:       stat.count,
+			Errors:      stat.errors,
+			Total:       Duration(stat.total),
+			P50:         Duration(percentile(samples, 0.5)),
+			P99:         Duration(percentile(samples, 0.99)),
+			Max:         Duration(stat.max),
+			LastSeen:    stat.lastSeen,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Total > result[j].Total })
+	return result
+}
+
+// WriteJSON 把 Snapshot 以 JSON 格式写到 w.
+func (l *SlowLog) WriteJSON(w io.Writer) error {
+	return json.NewEncoder(w).Encode(l.Snapshot())
+}
+
+// Reset 清空所有记录.
+func (l *SlowLog) Reset() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.stats = make(map[string]*slowStat)
+}
+
+// percentile 返回已经排序的 samples 的 p 分位数(nearest-rank).
+func percentile(samples []time.Duration, p float64) time.Duration {
+	if len(samples) == 0 {
+		return 0
+	}
+	rank := int(p*float64(len(samples))+0.999999) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(samples) {
+		rank = len(samples) - 1
+	}
+	return samples[rank]
+}
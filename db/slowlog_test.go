@@ -0,0 +1,146 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFingerprint(t *testing.T) {
+	tests := []struct {
+		driverName, query, want string
+	}{
+		{"mysql", "SELECT * FROM t WHERE id IN (1, 2, 3) AND name='x'", "select * from t where id in (?+) and name = ?"},
+		{"mysql", "select *\n  from t where id in (?,?) and name = 'it''s'", "select * from t where id in (?+) and name = ?"},
+		{"postgres", "/* c */ SELECT `Name`, \"Col\" FROM t WHERE a=$1 -- x\n AND b >= 1.5", "select `Name`, \"Col\" from t where a = ? and b >= ?"},
+		{"mysql", "INSERT INTO t (a, b) VALUES (1, 'x'), (2, 'y')", "insert into t (a, b) values (?+)"},
+		{"mysql", "SELECT a.b FROM t2 a WHERE c1 = 'a\\'b'", "select a.b from t2 a where c1 = ?"},
+		{"mysql", "SELECT 1 # comment\nFROM t", "select ? from t"},
+
+		// PostgreSQL 的 # 是运算符, 反斜杠不是转义字符
+		{"postgres", "SELECT data#>'{a}' FROM t WHERE id=1", "select data #> ? from t where id = ?"},
+		{"postgres", "SELECT a # b FROM t", "select a # b from t"},
+		{"postgres", "SELECT 'C:\\' FROM t WHERE id = 1", "select ? from t where id = ?"},
+
+		// 负数和正数归为一类, 减号保留
+		{"mysql", "SELECT * FROM t WHERE a=-1", "select * from t where a = ?"},
+		{"mysql", "SELECT * FROM t WHERE a = -1", "select * from t where a = ?"},
+		{"mysql", "SELECT * FROM t WHERE a=1", "select * from t where a = ?"},
+		{"mysql", "SELECT * FROM t WHERE a IN (-1, 2, -.5)", "select * from t where a in (?+)"},
+		{"mysql", "SELECT -1, b-1, b - 2 FROM t", "select ?, b - ?, b - ? from t"},
+		{"mysql", "UPDATE t SET a=a-1 WHERE b<-2", "update t set a = a - ? where b < ?"},
+	}
+	for _, tt := range tests {
+		if got := Fingerprint(tt.driverName, tt.query); got != tt.want {
+			t.Errorf("Fingerprint(%q, %q) = %q, want %q", tt.driverName, tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	samples := make([]time.Duration, 100)
+	for i := range samples {
+		samples[i] = time.Duration(i + 1)
+	}
+	tests := []struct {
+		samples []time.Duration
+		p       float64
+		want    time.Duration
+	}{
+		{nil, 0.5, 0},
+		{samples[:1], 0.99, 1},
+		{samples, 0.5, 50},
+		{samples, 0.99, 99},
+		{samples, 1, 100},
+		{samples, 0, 1},
+		{samples[:3], 0.5, 2},
+	}
+	for _, tt := range tests {
+		if got := percentile(tt.samples, tt.p); got != tt.want {
+			t.Errorf("percentile(%d samples, %v) = %v, want %v", len(tt.samples), tt.p, got, tt.want)
+		}
+	}
+}
+
+func TestSlowLog(t *testing.T) {
+	var slow []string
+	l := NewSlowLog(SlowLogOptions{
+		Threshold:  10 * time.Millisecond,
+		DriverName: "mysql",
+		OnSlowQuery: func(ctx context.Context, query string, dur time.Duration, err error) {
+			slow = append(slow, query)
+		},
+	})
+	ctx := context.Background()
+
+	l.AfterQuery(ctx, "SELECT * FROM t WHERE id = 1", nil, time.Millisecond, nil)
+	if len(l.Snapshot()) != 0 || len(slow) != 0 {
+		t.Fatal("query below the threshold is recorded")
+	}
+	l.AfterQuery(ctx, "SELECT * FROM t WHERE id = 1", nil, 10*time.Millisecond, nil)
+	l.AfterQuery(ctx, "SELECT * FROM t WHERE id = -2", nil, 30*time.Millisecond, errors.New("timeout"))
+	l.AfterQuery(ctx, "UPDATE t SET a = 1", nil, 100*time.Millisecond, nil)
+	if len(slow) != 3 {
+		t.Errorf("OnSlowQuery called %d times, want 3", len(slow))
+	}
+
+	snapshot := l.Snapshot()
+	if len(snapshot) != 2 {
+		t.Fatalf("snapshot = %+v", snapshot)
+	}
+	// 按照总耗时从大到小排列
+	if snapshot[0].Fingerprint != "update t set a = ?" {
+		t.Errorf("snapshot[0] = %+v", snapshot[0])
+	}
+	s := snapshot[1]
+	if s.Fingerprint != "select * from t where id = ?" || s.Example != "SELECT * FROM t WHERE id = -2" ||
+		s.Count != 2 || s.Errors != 1 || s.Total != Duration(40*time.Millisecond) ||
+		s.P50 != Duration(10*time.Millisecond) || s.P99 != Duration(30*time.Millisecond) || s.Max != Duration(30*time.Millisecond) {
+		t.Errorf("snapshot[1] = %+v", s)
+	}
+
+	var b strings.Builder
+	if err := l.WriteJSON(&b); err != nil {
+		t.Fatal(err)
+	}
+	var decoded []map[string]interface{}
+	if err := json.Unmarshal([]byte(b.String()), &decoded); err != nil || len(decoded) != 2 || decoded[1]["count"] != float64(2) {
+		t.Errorf("WriteJSON = %s, %v", b.String(), err)
+	}
+
+	l.Reset()
+	if len(l.Snapshot()) != 0 {
+		t.Error("Reset did not clear the log")
+	}
+}
+
+func TestSlowLogLimits(t *testing.T) {
+	l := NewSlowLog(SlowLogOptions{MaxFingerprints: 2, Samples: 2})
+
+	l.Record("SELECT a FROM t", time.Second, nil)
+	time.Sleep(time.Millisecond)
+	l.Record("SELECT b FROM t", time.Second, nil)
+	time.Sleep(time.Millisecond)
+	l.Record("SELECT c FROM t", time.Second, nil)
+
+	var fps []string
+	for _, s := range l.Snapshot() {
+		fps = append(fps, s.Fingerprint)
+	}
+	if len(fps) != 2 || strings.Contains(strings.Join(fps, ";"), "select a") {
+		t.Errorf("least recently seen fingerprint is not evicted: %q", fps)
+	}
+
+	// 只保留最近的 Samples 次执行时间用于计算分位数, Max 和 Total 统计所有的
+	for _, dur := range []time.Duration{9, 1, 2} {
+		l.Record("SELECT c FROM t", dur*time.Second, nil)
+	}
+	for _, s := range l.Snapshot() {
+		if s.Fingerprint == "select c from t" && (s.P99 != Duration(2*time.Second) || s.Max != Duration(9*time.Second) || s.Count != 4) {
+			t.Errorf("stats = %+v", s)
+		}
+	}
+}
@@ -2,44 +2,577 @@ package db
 
 import (
 	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
 	"reflect"
-	"time"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+var (
+	// ErrNothingToUpdate 表示 patch 中没有需要更新的字段, 只有自动填写的修改时间也算没有.
+	ErrNothingToUpdate = errors.New("db: nothing to update")
+
+	// ErrNoWhere 表示 UPDATE 没有 WHERE 条件, 为了避免误更新整个表, BuildUpdate 不生成这样的语句.
+	ErrNoWhere = errors.New("db: update without where condition")
+
+	// ErrStaleObject 表示检查版本的更新没有更新任何行: 记录已经被其他人修改, 或者已经删除.
+	ErrStaleObject = errors.New("db: stale object")
+
+	// ErrNothingToInsert 表示没有需要插入的字段或者行.
+	ErrNothingToInsert = errors.New("db: nothing to insert")
 )
 
+// SqlUpdateSetArgs 把 para 中不为 nil 的指针和切片字段写成 "col1=?, col2=?" 的形式, 参数追加到 args, 返回字段数.
+// 列名取 db tag, 没有时依次取 json tag 的名字和 utils.ToFieldName(字段名), tag 为 "-" 的字段被忽略;
+// 带 autoUpdateTime 选项的字段和修改时间列(默认 modified, 见 SetTimestampColumns)总是写入当前时间;
+// 带 version 选项的字段(db:"version,version")写成 "version=version+1", 见 BuildUpdate.
+// 匿名嵌入的结构体和带 prefix tag 的结构体字段递归展开, 见 parseFields.
+// para 为 nil 或者不是结构体时返回 0, 不写入 s; 需要知道原因时使用 UpdateSetArgs.
 func SqlUpdateSetArgs(s *bytes.Buffer, para interface{}, args *[]interface{}) int {
-	x := 0
-	v := reflect.Indirect(reflect.ValueOf(para))
+	return updateSetArgs(s, para, args).fields
+}
 
-	for i := 0; i < v.NumField(); i++ {
-		field := v.Field(i)
-		if field.Kind() != reflect.Ptr && field.Kind() != reflect.Slice {
+// UpdateSetArgs 同 SqlUpdateSetArgs, 但是 para 为 nil, 不是结构体或者 tag 有错误时返回错误.
+func UpdateSetArgs(s *bytes.Buffer, para interface{}, args *[]interface{}) (int, error) {
+	set := updateSetArgs(s, para, args)
+	return set.fields, set.err
+}
+
+// updateSet 是 updateSetArgs 的结果.
+type updateSet struct {
+	fields  int          // 写入的字段数
+	auto    int          // 其中自动维护的字段数: 修改时间和版本
+	version *versionLock // 需要检查的版本, 没有时为 nil
+	err     error
+}
+
+// versionLock 是乐观锁的版本列和更新前的版本.
+type versionLock struct {
+	column string
+	value  interface{}
+}
+
+// updateSetArgs 同 UpdateSetArgs.
+func updateSetArgs(s *bytes.Buffer, para interface{}, args *[]interface{}) (set updateSet) {
+	v, err := structValue(para)
+	if err != nil {
+		set.err = err
+		return
+	}
+	info := getStructInfo(v.Type())
+	if info.err != nil {
+		set.err = info.err
+		return
+	}
+	ts := getTimestamps()
+
+	for _, f := range info.fields {
+		field := fieldByIndex(v, f.index)
+		key := f.column
+
+		if ts.onUpdate(f) {
+			if set.fields > 0 {
+				s.WriteString(", ")
+			}
+			s.WriteString(key + "=?")
+			*args = append(*args, ts.value(f))
+			set.fields++
+			set.auto++
+			continue
+		}
+
+		if f.hasOption("version") {
+			// 指针字段为 nil 时只增加版本, 不检查
+			if field.IsValid() && !(field.Kind() == reflect.Ptr && field.IsNil()) {
+				set.version = &versionLock{column: key, value: reflect.Indirect(field).Interface()}
+			}
+			if set.fields > 0 {
+				s.WriteString(", ")
+			}
+			s.WriteString(key + "=" + key + "+1")
+			set.fields++
+			set.auto++
 			continue
 		}
 
-		key := v.Type().Field(i).Tag.Get("json")
+		if field.Kind() != reflect.Ptr && field.Kind() != reflect.Slice {
+			continue
+		}
 
-		if field.IsNil() == false || key == "modified" {
-			if x > 0 {
+		if field.IsNil() == false {
+			if set.fields > 0 {
 				s.WriteString(", ")
 			}
 
 			s.WriteString(key)
 			s.WriteString("=?")
-			if key == "modified" {
-				*args = append(*args, time.Now().Unix())
+			if field.Kind() == reflect.Ptr {
+				*args = append(*args, field.Elem().Interface())
 			} else {
-				if field.Kind() == reflect.Ptr {
-					*args = append(*args, field.Elem().Interface())
-				} else {
-					*args = append(*args, field.Slice(0, field.Len()).Interface())
-				}
+				*args = append(*args, field.Slice(0, field.Len()).Interface())
 			}
 
-			x++
+			set.fields++
 		}
 	}
 
 	s.WriteString(" ")
 
-	return x
+	return
+}
+
+// BuildUpdate 生成 "UPDATE table SET ... WHERE ..." 语句, SET 部分同 SqlUpdateSetArgs, WHERE 部分来自 where.
+// patch 中没有需要更新的字段时返回 ErrNothingToUpdate, where 没有条件时返回 ErrNoWhere.
+// where 中的切片参数会展开为 IN (?, ?, ...). 返回的语句使用 ? 作为占位符.
+//
+//	query, args, err := db.BuildUpdate("users", &UserPatch{Name: &name}, new(db.Filter).Where("id = ?", id))
+//
+// patch 有 version 选项的字段并且不为 nil 时, 它的值是更新前的版本, WHERE 中增加 "AND version = ?",
+// 版本不一致时不会更新任何行, 见 Update.
+func BuildUpdate(table string, patch interface{}, where *Filter) (query string, args []interface{}, err error) {
+	query, args, _, err = buildUpdate(table, patch, where)
+	return
+}
+
+func buildUpdate(table string, patch interface{}, where *Filter) (query string, args []interface{}, version *versionLock, err error) {
+	var s bytes.Buffer
+	s.WriteString("UPDATE ")
+	s.WriteString(table)
+	s.WriteString(" SET ")
+
+	set := updateSetArgs(&s, patch, &args)
+	if set.err != nil {
+		return "", nil, nil, set.err
+	}
+	if set.fields == set.auto {
+		return "", nil, nil, ErrNothingToUpdate
+	}
+
+	whereSql, whereArgs, err := buildWhere(where)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	if set.version != nil {
+		whereSql = "WHERE (" + strings.TrimPrefix(whereSql, "WHERE ") + ") AND " + set.version.column + " = ?"
+		whereArgs = append(whereArgs, set.version.value)
+	}
+	s.WriteString(whereSql)
+	return s.String(), append(args, whereArgs...), set.version, nil
+}
+
+// buildWhere 返回 where 的 WHERE 子句和参数, 不改变 where.SqlVars, 同一个 Filter 可以多次使用.
+func buildWhere(where *Filter) (string, []interface{}, error) {
+	if where == nil {
+		return "", nil, ErrNoWhere
+	}
+
+	n := len(where.SqlVars)
+	whereSql := where.WhereSql()
+	vars := append([]interface{}{}, where.SqlVars[n:]...)
+	where.SqlVars = where.SqlVars[:n]
+	if whereSql == "" {
+		return "", nil, ErrNoWhere
+	}
+	return sqlx.In(whereSql, vars...)
+}
+
+// Update 使用 BuildUpdate 生成的语句更新 table, 通过缓存的 Stmt 执行, 占位符按照驱动转换.
+// 检查版本的更新没有更新任何行时返回 ErrStaleObject.
+func (h *Handle) Update(ctx context.Context, table string, patch interface{}, where *Filter) (sql.Result, error) {
+	query, args, version, err := buildUpdate(table, patch, where)
+	if err != nil {
+		return nil, err
+	}
+	result, err := h.ExecContext(ctx, h.rebind(query), args...)
+	if err != nil || version == nil {
+		return result, err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return result, err
+	} else if n == 0 {
+		return result, ErrStaleObject
+	}
+	return result, nil
+}
+
+// rebind 把 ? 占位符转换为主库驱动使用的形式, 比如 PostgreSQL 的 $1.
+func (h *Handle) rebind(query string) string {
+	if d := h.GetDB(); d != nil {
+		return d.Rebind(query)
+	}
+	return query
+}
+
+func Update(ctx context.Context, table string, patch interface{}, where *Filter) (sql.Result, error) {
+	return defaultHandle.Update(ctx, table, patch, where)
+}
+
+// Statement 是生成的一条语句和它的参数.
+type Statement struct {
+	Query string
+	Args  []interface{}
+}
+
+// BuildInsert 生成插入 v 的 "INSERT INTO table (...) VALUES (...)" 语句, v 是结构体或者结构体指针.
+// 列名规则同 SqlUpdateSetArgs; 值为 nil 的指针字段和值为零的 autoIncrement 字段(db:"id,autoIncrement")不插入,
+// 由数据库使用默认值; 带 autoCreateTime, autoUpdateTime 选项的字段和创建时间列, 修改时间列的值为零时填写当前时间,
+// 见 SetTimestampColumns 和 SetClock.
+// 返回的语句使用 ? 作为占位符.
+func BuildInsert(table string, v interface{}) (query string, args []interface{}, err error) {
+	rv, err := structValue(v)
+	if err != nil {
+		return "", nil, err
+	}
+
+	info := getStructInfo(rv.Type())
+	if info.err != nil {
+		return "", nil, info.err
+	}
+	fields := info.fields
+	values, present := insertValues(rv, fields, getTimestamps())
+
+	var columns []string
+	for i, f := range fields {
+		if present[i] {
+			columns = append(columns, f.column)
+			args = append(args, values[i])
+		}
+	}
+	if len(columns) == 0 {
+		return "", nil, ErrNothingToInsert
+	}
+	return insertPrefix(table, columns) + placeholders(len(columns)), args, nil
+}
+
+// BuildBatchInsert 生成插入 slice 中所有元素的 "INSERT INTO table (...) VALUES (...), (...)" 语句,
+// slice 的元素是结构体或者结构体指针. 字段规则同 BuildInsert, 每行只插入 BuildInsert 会插入的列,
+// 不插入的列使用数据库的默认值, 而不是 NULL; 比如为 0 的自增 ID 仍然由数据库分配.
+// 插入的列相同的相邻行合并为一条语句, 列不同时分成多条语句, 行的顺序不变;
+// 参数个数超过默认句柄的驱动的占位符上限时也分成多条语句.
+func BuildBatchInsert(table string, slice interface{}) ([]Statement, error) {
+	return buildBatchInsert(table, slice, placeholderLimit(defaultHandle.GetDB()))
+}
+
+func buildBatchInsert(table string, slice interface{}, limit int) ([]Statement, error) {
+	sv := reflect.Indirect(reflect.ValueOf(slice))
+	if sv.Kind() != reflect.Slice && sv.Kind() != reflect.Array {
+		return nil, fmt.Errorf("db: BuildBatchInsert: %T is not a slice", slice)
+	}
+	if sv.Len() == 0 {
+		return nil, ErrNothingToInsert
+	}
+	elemType := sv.Type().Elem()
+	if elemType.Kind() == reflect.Ptr {
+		elemType = elemType.Elem()
+	}
+	if elemType.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("db: BuildBatchInsert: %T is not a slice of structs", slice)
+	}
+
+	info := getStructInfo(elemType)
+	if info.err != nil {
+		return nil, info.err
+	}
+	fields := info.fields
+	ts := getTimestamps()
+
+	var (
+		stmts      []Statement
+		err        error
+		run        [][]interface{} // 插入的列相同的相邻行
+		runPresent []bool
+	)
+	for i := 0; i < sv.Len(); i++ {
+		rv := reflect.Indirect(sv.Index(i))
+		if !rv.IsValid() {
+			return nil, fmt.Errorf("db: BuildBatchInsert: element %d is nil", i)
+		}
+		values, present := insertValues(rv, fields, ts)
+		if len(run) > 0 && !reflect.DeepEqual(present, runPresent) {
+			if stmts, err = appendBatchInsert(stmts, table, fields, runPresent, run, limit); err != nil {
+				return nil, err
+			}
+			run = nil
+		}
+		run, runPresent = append(run, values), present
+	}
+	return appendBatchInsert(stmts, table, fields, runPresent, run, limit)
+}
+
+// appendBatchInsert 把插入 rows 中 present 的列的语句加到 stmts 后面, 参数个数超过 limit 时分成多条.
+func appendBatchInsert(stmts []Statement, table string, fields []*fieldInfo, present []bool, rows [][]interface{}, limit int) ([]Statement, error) {
+	var columns []string
+	for j, f := range fields {
+		if present[j] {
+			columns = append(columns, f.column)
+		}
+	}
+	if len(columns) == 0 {
+		return nil, ErrNothingToInsert
+	}
+	if len(columns) > limit {
+		return nil, fmt.Errorf("db: BuildBatchInsert: %d columns exceed the placeholder limit %d", len(columns), limit)
+	}
+
+	prefix := insertPrefix(table, columns)
+	row := placeholders(len(columns))
+	perStmt := limit / len(columns)
+
+	for start := 0; start < len(rows); start += perStmt {
+		end := start + perStmt
+		if end > len(rows) {
+			end = len(rows)
+		}
+
+		var s strings.Builder
+		s.WriteString(prefix)
+		args := make([]interface{}, 0, (end-start)*len(columns))
+		for i := start; i < end; i++ {
+			if i > start {
+				s.WriteString(", ")
+			}
+			s.WriteString(row)
+			for j, value := range rows[i] {
+				if present[j] {
+					args = append(args, value)
+				}
+			}
+		}
+		stmts = append(stmts, Statement{Query: s.String(), Args: args})
+	}
+	return stmts, nil
+}
+
+// insertValues 返回 v 中每个字段要插入的值, present[i] 为 false 表示第 i 个字段不插入.
+func insertValues(v reflect.Value, fields []*fieldInfo, ts timestamps) (values []interface{}, present []bool) {
+	values = make([]interface{}, len(fields))
+	present = make([]bool, len(fields))
+
+	for i, f := range fields {
+		field := fieldByIndex(v, f.index)
+		switch {
+		case ts.onCreate(f) && (!field.IsValid() || field.IsZero()):
+			values[i] = ts.value(f)
+		case !field.IsValid():
+			continue
+		case field.Kind() == reflect.Ptr && field.IsNil():
+			continue
+		case f.hasOption("autoIncrement") && field.IsZero():
+			continue
+		case field.Kind() == reflect.Ptr:
+			values[i] = field.Elem().Interface()
+		default:
+			values[i] = field.Interface()
+		}
+		present[i] = true
+	}
+	return
+}
+
+func insertPrefix(table string, columns []string) string {
+	return "INSERT INTO " + table + " (" + strings.Join(columns, ", ") + ") VALUES "
+}
+
+// placeholders 返回 "(?, ?, ...)".
+func placeholders(n int) string {
+	return "(" + strings.Repeat("?, ", n-1) + "?)"
+}
+
+// placeholderLimit 返回一条语句中最多可以使用的参数个数.
+func placeholderLimit(d *sqlx.DB) int {
+	if d == nil {
+		return 999
+	}
+	switch d.DriverName() {
+	case "mysql", "postgres", "pgx":
+		return 65535
+	case "sqlite3":
+		return 32766
+	}
+	return 999 // SQLite 3.32 之前的默认值, 也是常见驱动中最小的
+}
+
+// Insert 插入 v 并返回 LastInsertId, 语句见 BuildInsert; 驱动不支持 LastInsertId 时(比如 PostgreSQL)返回它的错误.
+func (h *Handle) Insert(ctx context.Context, table string, v interface{}) (id int64, err error) {
+	query, args, err := BuildInsert(table, v)
+	if err != nil {
+		return 0, err
+	}
+	result, err := h.ExecContext(ctx, h.rebind(query), args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// BatchInsert 插入 slice 中的所有元素并返回插入的行数, 语句见 BuildBatchInsert.
+// 分成多条语句时在一个事务中执行.
+func (h *Handle) BatchInsert(ctx context.Context, table string, slice interface{}) (affected int64, err error) {
+	stmts, err := buildBatchInsert(table, slice, placeholderLimit(h.GetDB()))
+	if err != nil {
+		return 0, err
+	}
+
+	if len(stmts) == 1 {
+		result, err := h.ExecContext(ctx, h.rebind(stmts[0].Query), stmts[0].Args...)
+		if err != nil {
+			return 0, err
+		}
+		return result.RowsAffected()
+	}
+
+	err = h.WithTx(ctx, nil, func(tx *Tx) error {
+		affected = 0
+		for _, s := range stmts {
+			// 每条语句的参数很多而且只执行一次, 直接在事务上执行, 不创建 Stmt
+			result, err := tx.ExecContext(ctx, h.rebind(s.Query), s.Args...)
+			if err != nil {
+				return err
+			}
+			n, err := result.RowsAffected()
+			if err != nil {
+				return err
+			}
+			affected += n
+		}
+		return nil
+	})
+	return
+}
+
+func Insert(ctx context.Context, table string, v interface{}) (int64, error) {
+	return defaultHandle.Insert(ctx, table, v)
+}
+
+func BatchInsert(ctx context.Context, table string, slice interface{}) (int64, error) {
+	return defaultHandle.BatchInsert(ctx, table, slice)
+}
+
+// BuildUpsert 生成插入 patch, 冲突时更新的语句, 插入部分同 BuildInsert, driverName 同 sqlx.DB.DriverName():
+//
+//	MySQL:             INSERT ... ON DUPLICATE KEY UPDATE col=VALUES(col), ...
+//	PostgreSQL/SQLite: INSERT ... ON CONFLICT (key, ...) DO UPDATE SET col=EXCLUDED.col, ...
+//
+// 冲突键是带 conflict 选项的字段(db:"id,conflict"), PostgreSQL 和 SQLite 必须有, MySQL 忽略它而使用表上的唯一键.
+// 冲突时更新的列是带 update 选项的字段; 没有字段带 update 选项时更新插入的所有列, 但是不包括冲突键和只在插入时填写的时间列.
+// 带 version 选项的字段冲突时加一. 没有需要更新的列时 MySQL 生成 key=key, PostgreSQL 和 SQLite 生成 DO NOTHING.
+func BuildUpsert(driverName, table string, patch interface{}) (query string, args []interface{}, err error) {
+	rv, err := structValue(patch)
+	if err != nil {
+		return "", nil, err
+	}
+
+	info := getStructInfo(rv.Type())
+	if info.err != nil {
+		return "", nil, info.err
+	}
+	fields := info.fields
+	ts := getTimestamps()
+	values, present := insertValues(rv, fields, ts)
+
+	explicit := false
+	for _, f := range fields {
+		if f.hasOption("update") {
+			explicit = true
+			break
+		}
+	}
+
+	var columns, keys, updates, versions []string
+	for i, f := range fields {
+		if f.hasOption("conflict") {
+			keys = append(keys, f.column)
+		}
+		if !present[i] {
+			continue
+		}
+		columns = append(columns, f.column)
+		args = append(args, values[i])
+
+		if f.hasOption("version") {
+			versions = append(versions, f.column)
+		} else if explicit {
+			if f.hasOption("update") {
+				updates = append(updates, f.column)
+			}
+		} else if !f.hasOption("conflict") && (!ts.onCreate(f) || ts.onUpdate(f)) {
+			updates = append(updates, f.column)
+		}
+	}
+	if len(columns) == 0 {
+		return "", nil, ErrNothingToInsert
+	}
+
+	var s strings.Builder
+	s.WriteString(insertPrefix(table, columns))
+	s.WriteString(placeholders(len(columns)))
+
+	switch driverName {
+	case "mysql":
+		s.WriteString(" ON DUPLICATE KEY UPDATE ")
+		if len(updates) == 0 && len(versions) == 0 {
+			// 没有需要更新的列时用一个不改变数据的赋值, 不使用 INSERT IGNORE, 它会忽略其他错误
+			s.WriteString(columns[0] + "=" + columns[0])
+		}
+		for i, column := range updates {
+			if i > 0 {
+				s.WriteString(", ")
+			}
+			s.WriteString(column + "=VALUES(" + column + ")")
+		}
+		for i, column := range versions {
+			if i > 0 || len(updates) > 0 {
+				s.WriteString(", ")
+			}
+			s.WriteString(column + "=" + column + "+1")
+		}
+
+	case "postgres", "pgx", "sqlite3":
+		if len(keys) == 0 {
+			return "", nil, fmt.Errorf("db: BuildUpsert: %T has no conflict key", patch)
+		}
+		s.WriteString(" ON CONFLICT (" + strings.Join(keys, ", ") + ") DO ")
+		if len(updates) == 0 && len(versions) == 0 {
+			s.WriteString("NOTHING")
+		} else {
+			s.WriteString("UPDATE SET ")
+		}
+		for i, column := range updates {
+			if i > 0 {
+				s.WriteString(", ")
+			}
+			s.WriteString(column + "=EXCLUDED." + column)
+		}
+		for i, column := range versions {
+			if i > 0 || len(updates) > 0 {
+				s.WriteString(", ")
+			}
+			s.WriteString(column + "=" + table + "." + column + "+1")
+		}
+
+	default:
+		return "", nil, fmt.Errorf("db: BuildUpsert: unsupported driver %q", driverName)
+	}
+	return s.String(), args, nil
+}
+
+// Upsert 插入 patch, 冲突时更新, 语句见 BuildUpsert.
+func (h *Handle) Upsert(ctx context.Context, table string, patch interface{}) (sql.Result, error) {
+	d := h.GetDB()
+	if d == nil {
+		return nil, fmt.Errorf("db: handle %q has no database", h.name)
+	}
+	query, args, err := BuildUpsert(d.DriverName(), table, patch)
+	if err != nil {
+		return nil, err
+	}
+	return h.ExecContext(ctx, d.Rebind(query), args...)
+}
+
+func Upsert(ctx context.Context, table string, patch interface{}) (sql.Result, error) {
+	return defaultHandle.Upsert(ctx, table, patch)
 }
@@ -0,0 +1,328 @@
+package db
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+type userPatch struct {
+	Name *string `db:"name"`
+	Age  *int    `db:"age"`
+}
+
+func TestBuildUpdate(t *testing.T) {
+	name := "bob"
+	where := new(Filter).Where("id IN (?)", []int{1, 2})
+	query, args, err := BuildUpdate("users", &userPatch{Name: &name}, where)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "UPDATE users SET name=? WHERE (id IN (?, ?))"; query != want {
+		t.Errorf("query = %q, want %q", query, want)
+	}
+	if !reflect.DeepEqual(args, []interface{}{"bob", 1, 2}) {
+		t.Errorf("args = %v", args)
+	}
+
+	// 同一个 Filter 可以再次使用
+	if again, _, err := BuildUpdate("users", &userPatch{Name: &name}, where); err != nil || again != query {
+		t.Errorf("reused filter: %q, %v", again, err)
+	}
+}
+
+func TestBuildUpdateErrors(t *testing.T) {
+	name := "bob"
+	if _, _, err := BuildUpdate("users", &userPatch{}, new(Filter).Where("id = ?", 1)); err != ErrNothingToUpdate {
+		t.Errorf("empty patch: %v", err)
+	}
+	if _, _, err := BuildUpdate("users", &userPatch{Name: &name}, nil); err != ErrNoWhere {
+		t.Errorf("nil filter: %v", err)
+	}
+	if _, _, err := BuildUpdate("users", &userPatch{Name: &name}, new(Filter)); err != ErrNoWhere {
+		t.Errorf("empty filter: %v", err)
+	}
+	if _, _, err := BuildUpdate("users", nil, new(Filter).Where("id = ?", 1)); err == nil {
+		t.Error("nil patch: no error")
+	}
+}
+
+func TestHandleUpdate(t *testing.T) {
+	d, fd := newFakeDB(t)
+	h := newHandle("test")
+	h.SetDB(d)
+
+	age := 3
+	if _, err := h.Update(context.Background(), "users", &userPatch{Age: &age}, new(Filter).Where("id = ?", 1)); err != nil {
+		t.Fatal(err)
+	}
+	if fd.count("exec UPDATE users SET age=? WHERE (id = ?)") != 1 {
+		t.Errorf("ops = %q", fd.ops)
+	}
+}
+
+type versionedPatch struct {
+	Name    *string `db:"name"`
+	Version *int    `db:"version,version"`
+}
+
+func TestBuildUpdateVersion(t *testing.T) {
+	name, version := "bob", 3
+	query, args, err := BuildUpdate("users", &versionedPatch{Name: &name, Version: &version}, new(Filter).Where("id = ?", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "UPDATE users SET name=?, version=version+1 WHERE ((id = ?)) AND version = ?"; query != want {
+		t.Errorf("query = %q, want %q", query, want)
+	}
+	if !reflect.DeepEqual(args, []interface{}{"bob", 1, 3}) {
+		t.Errorf("args = %v", args)
+	}
+
+	// Or 条件整体加括号, 版本检查对所有的行生效
+	query, _, err = BuildUpdate("users", &versionedPatch{Name: &name, Version: &version}, new(Filter).Where("id = ?", 1).Or("id = ?", 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "UPDATE users SET name=?, version=version+1 WHERE ((id = ?) OR (id = ?)) AND version = ?"; query != want {
+		t.Errorf("query = %q, want %q", query, want)
+	}
+
+	// 版本为 nil 时只增加版本, 不检查
+	query, _, err = BuildUpdate("users", &versionedPatch{Name: &name}, new(Filter).Where("id = ?", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "UPDATE users SET name=?, version=version+1 WHERE (id = ?)"; query != want {
+		t.Errorf("query = %q, want %q", query, want)
+	}
+}
+
+func TestHandleUpdateStale(t *testing.T) {
+	d, fd := newFakeDB(t)
+	h := newHandle("test")
+	h.SetDB(d)
+	ctx := context.Background()
+	name, version := "bob", 3
+
+	if _, err := h.Update(ctx, "users", &versionedPatch{Name: &name, Version: &version}, new(Filter).Where("id = ?", 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	fd.mutex.Lock()
+	fd.noRows = true
+	fd.mutex.Unlock()
+	if _, err := h.Update(ctx, "users", &versionedPatch{Name: &name, Version: &version}, new(Filter).Where("id = ?", 1)); err != ErrStaleObject {
+		t.Errorf("err = %v, want ErrStaleObject", err)
+	}
+	// 不检查版本的更新没有影响任何行不是错误
+	if _, err := h.Update(ctx, "users", &versionedPatch{Name: &name}, new(Filter).Where("id = ?", 1)); err != nil {
+		t.Errorf("unversioned update: %v", err)
+	}
+}
+
+type insertRow struct {
+	ID   int64   `db:"id,autoIncrement"`
+	Name string  `db:"name"`
+	Note *string `db:"note"`
+}
+
+func TestBuildInsert(t *testing.T) {
+	query, args, err := BuildInsert("users", &insertRow{Name: "bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "INSERT INTO users (name) VALUES (?)"; query != want {
+		t.Errorf("query = %q, want %q", query, want)
+	}
+	if !reflect.DeepEqual(args, []interface{}{"bob"}) {
+		t.Errorf("args = %v", args)
+	}
+
+	note := "n"
+	query, args, _ = BuildInsert("users", insertRow{ID: 7, Name: "amy", Note: &note})
+	if want := "INSERT INTO users (id, name, note) VALUES (?, ?, ?)"; query != want {
+		t.Errorf("query = %q, want %q", query, want)
+	}
+	if !reflect.DeepEqual(args, []interface{}{int64(7), "amy", "n"}) {
+		t.Errorf("args = %v", args)
+	}
+
+	type empty struct {
+		Note *string `db:"note"`
+	}
+	if _, _, err = BuildInsert("users", &empty{}); err != ErrNothingToInsert {
+		t.Errorf("empty insert: %v", err)
+	}
+}
+
+func TestBuildBatchInsert(t *testing.T) {
+	note := "n"
+	rows := []*insertRow{{Name: "a"}, {Name: "b", Note: &note}, {Name: "c"}}
+	stmts, err := buildBatchInsert("users", rows, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 列不同的行分成多条语句, 不插入的列使用默认值而不是 NULL
+	want := []Statement{
+		{"INSERT INTO users (name) VALUES (?)", []interface{}{"a"}},
+		{"INSERT INTO users (name, note) VALUES (?, ?)", []interface{}{"b", "n"}},
+		{"INSERT INTO users (name) VALUES (?)", []interface{}{"c"}},
+	}
+	if !reflect.DeepEqual(stmts, want) {
+		t.Errorf("stmts = %v, want %v", stmts, want)
+	}
+
+	// 为 0 的自增 ID 不插入, 由数据库分配; 列相同的相邻行按照 limit 分成多条
+	rows = []*insertRow{{ID: 5, Name: "a"}, {Name: "b"}, {Name: "c"}, {Name: "d"}, {Name: "e"}, {ID: 9, Name: "f"}}
+	if stmts, err = buildBatchInsert("users", rows, 4); err != nil {
+		t.Fatal(err)
+	}
+	want = []Statement{
+		{"INSERT INTO users (id, name) VALUES (?, ?)", []interface{}{int64(5), "a"}},
+		{"INSERT INTO users (name) VALUES (?), (?), (?), (?)", []interface{}{"b", "c", "d", "e"}},
+		{"INSERT INTO users (id, name) VALUES (?, ?)", []interface{}{int64(9), "f"}},
+	}
+	if !reflect.DeepEqual(stmts, want) {
+		t.Errorf("stmts = %v, want %v", stmts, want)
+	}
+
+	if _, err = buildBatchInsert("users", []insertRow{}, 4); err != ErrNothingToInsert {
+		t.Errorf("empty slice: %v", err)
+	}
+	if _, err = buildBatchInsert("users", []int{1}, 4); err == nil {
+		t.Error("slice of ints: no error")
+	}
+	if _, err = buildBatchInsert("users", []*insertRow{nil}, 4); err == nil {
+		t.Error("nil element: no error")
+	}
+}
+
+func TestBatchInsertChunksSkipStmtCache(t *testing.T) {
+	d, fd := newFakeDB(t)
+	h := newHandle("test")
+	h.SetDB(d)
+
+	rows := make([]insertRow, 1000)
+	for i := range rows {
+		rows[i].Name = "x"
+	}
+	// 每行只插入 name 一列, mysql 的占位符上限是 65535: 1000 行是一条语句, 通过缓存的 Stmt 执行
+	n, err := h.BatchInsert(context.Background(), "users", rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("affected = %d", n) // fakeDriver 每条语句返回 1
+	}
+
+	// 70000 行分成两条语句在事务中执行, 不进入 Stmt 缓存
+	big := make([]insertRow, 70000)
+	for i := range big {
+		big[i].Name = "x"
+	}
+	if n, err = h.BatchInsert(context.Background(), "users", big); err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 || fd.count("begin") != 1 || fd.count("commit") != 1 {
+		t.Errorf("affected = %d, ops = %d begin, %d commit", n, fd.count("begin"), fd.count("commit"))
+	}
+	if size := h.primaryNode().stmtSet.len(); size != 1 {
+		t.Errorf("chunk statements are cached: cache size = %d", size)
+	}
+}
+
+func TestBuildUpsert(t *testing.T) {
+	type account struct {
+		ID      int64  `db:"id,conflict"`
+		Name    string `db:"name"`
+		Balance int    `db:"balance"`
+	}
+	type explicit struct {
+		ID      int64  `db:"id,conflict"`
+		Name    string `db:"name"`
+		Balance int    `db:"balance,update"`
+	}
+	type keyOnly struct {
+		ID int64 `db:"id,conflict"`
+	}
+	type versioned struct {
+		ID      int64  `db:"id,conflict"`
+		Name    string `db:"name"`
+		Version int    `db:"version,version"`
+	}
+	type noKey struct {
+		Name string `db:"name"`
+	}
+
+	tests := []struct {
+		driverName string
+		patch      interface{}
+		want       string
+	}{
+		{"mysql", &account{ID: 1, Name: "a", Balance: 2},
+			"INSERT INTO accounts (id, name, balance) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE name=VALUES(name), balance=VALUES(balance)"},
+		{"postgres", &account{ID: 1, Name: "a", Balance: 2},
+			"INSERT INTO accounts (id, name, balance) VALUES (?, ?, ?) ON CONFLICT (id) DO UPDATE SET name=EXCLUDED.name, balance=EXCLUDED.balance"},
+		{"sqlite3", &explicit{ID: 1, Name: "a", Balance: 2},
+			"INSERT INTO accounts (id, name, balance) VALUES (?, ?, ?) ON CONFLICT (id) DO UPDATE SET balance=EXCLUDED.balance"},
+		{"mysql", &keyOnly{ID: 1},
+			"INSERT INTO accounts (id) VALUES (?) ON DUPLICATE KEY UPDATE id=id"},
+		{"pgx", &keyOnly{ID: 1},
+			"INSERT INTO accounts (id) VALUES (?) ON CONFLICT (id) DO NOTHING"},
+		{"mysql", &versioned{ID: 1, Name: "a", Version: 1},
+			"INSERT INTO accounts (id, name, version) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE name=VALUES(name), version=version+1"},
+		{"postgres", &versioned{ID: 1, Name: "a", Version: 1},
+			"INSERT INTO accounts (id, name, version) VALUES (?, ?, ?) ON CONFLICT (id) DO UPDATE SET name=EXCLUDED.name, version=accounts.version+1"},
+	}
+	for _, tt := range tests {
+		query, _, err := BuildUpsert(tt.driverName, "accounts", tt.patch)
+		if err != nil {
+			t.Errorf("%s %T: %v", tt.driverName, tt.patch, err)
+		} else if query != tt.want {
+			t.Errorf("%s %T:\n got %q\nwant %q", tt.driverName, tt.patch, query, tt.want)
+		}
+	}
+
+	if _, _, err := BuildUpsert("postgres", "accounts", &noKey{Name: "a"}); err == nil {
+		t.Error("postgres without conflict key: no error")
+	}
+	if _, _, err := BuildUpsert("mssql", "accounts", &account{ID: 1}); err == nil {
+		t.Error("unsupported driver: no error")
+	}
+}
+
+func TestHandleUpsert(t *testing.T) {
+	type account struct {
+		ID   int64  `db:"id,conflict"`
+		Name string `db:"name"`
+	}
+	d, fd := newFakeDB(t)
+	h := newHandle("test")
+	h.SetDB(d)
+
+	if _, err := h.Upsert(context.Background(), "accounts", &account{ID: 1, Name: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if fd.count("exec INSERT INTO accounts (id, name) VALUES (?, ?) ON DUPLICATE KEY UPDATE name=VALUES(name)") != 1 {
+		t.Errorf("ops = %q", fd.ops)
+	}
+
+	if _, err := newHandle("empty").Upsert(context.Background(), "accounts", &account{ID: 1}); err == nil {
+		t.Error("Upsert without database: no error")
+	}
+}
+
+func TestBuildInsertNested(t *testing.T) {
+	name := "n"
+	query, _, err := BuildInsert("t", nestedPatch{Name: &name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "INSERT INTO t (modified, name) VALUES (?, ?)"; query != want {
+		t.Errorf("query = %q, want %q", query, want)
+	}
+	if _, _, err := BuildInsert("t", (*nestedPatch)(nil)); err == nil {
+		t.Error("nil pointer: no error")
+	}
+}
@@ -0,0 +1,211 @@
+package db
+
+import (
+	"bufio"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StmtStats 是一个缓存的 Stmt 的统计信息.
+type StmtStats struct {
+	Fingerprint string // 归一化的 query, 见 Fingerprint; 用于在监控系统中标识一类 query
+	Query       string
+	Hits        int64 // 缓存命中次数
+	PrepareTime time.Duration
+	Created     time.Time
+	LastUsed    time.Time
+}
+
+// CacheStats 是一个 Stmt 缓存的统计信息, 计数器从创建缓存开始累计.
+type CacheStats struct {
+	Size          int
+	MaxSize       int
+	Hits          int64
+	Misses        int64
+	Prepares      int64         // 成功创建 Stmt 的次数
+	PrepareErrors int64         // 创建 Stmt 失败的次数
+	PrepareTime   time.Duration // 创建 Stmt 的总耗时, 包括失败的
+	Evictions     int64         // 因为容量, 过期, 失效和清理被删除的次数, 不包括 CloseAllStmt
+	Closing       int           // 已经被删除, 等待 CloseDelay 之后关闭的 Stmt 数量, 不计入 Size
+	Entries       []StmtStats   // 按照最近使用的顺序排列
+
+	// FingerprintHits 是每个 Fingerprint 累计的缓存命中次数, 和 Hits 一样从创建缓存开始累计,
+	// Stmt 被淘汰或者清理之后不会减少; Entries 中的 Hits 只包括当前缓存的 Stmt.
+	FingerprintHits map[string]int64
+}
+
+// HitRate 返回缓存命中率, 没有访问时返回 0.
+func (s CacheStats) HitRate() float64 {
+	if total := s.Hits + s.Misses; total > 0 {
+		return float64(s.Hits) / float64(total)
+	}
+	return 0
+}
+
+// ByFingerprint 按照 Fingerprint 汇总 Entries, 只有常量或者 IN 列表长度不同的 query 汇总为一项,
+// 避免监控系统中的标签数量随参数增长. Hits 相加, Created 取最早的, PrepareTime 和 LastUsed 取最大的,
+// Query 是最近使用的一个; 结果按照最近使用的顺序排列.
+func (s CacheStats) ByFingerprint() []StmtStats {
+	var result []StmtStats
+	index := make(map[string]int, len(s.Entries))
+	for _, e := range s.Entries {
+		i, ok := index[e.Fingerprint]
+		if !ok {
+			index[e.Fingerprint] = len(result)
+			result = append(result, e)
+			continue
+		}
+		agg := &result[i]
+		agg.Hits += e.Hits
+		if e.Created.Before(agg.Created) {
+			agg.Created = e.Created
+		}
+		if e.PrepareTime > agg.PrepareTime {
+			agg.PrepareTime = e.PrepareTime
+		}
+		if e.LastUsed.After(agg.LastUsed) {
+			agg.LastUsed = e.LastUsed
+		}
+	}
+	return result
+}
+
+// NodeStats 是主库或者一个从库的 Stmt 缓存统计信息.
+type NodeStats struct {
+	Name      string // "primary" 或者 "replica0", "replica1", ...
+	Stmt      CacheStats
+	NamedStmt CacheStats
+}
+
+// HandleStats 是一个 Handle 的统计信息, Nodes[0] 是主库.
+type HandleStats struct {
+	Name  string
+	Nodes []NodeStats
+}
+
+// Stats 返回 Stmt 缓存的统计信息快照.
+func (h *Handle) Stats() HandleStats {
+	nodes := h.nodes()
+	stats := HandleStats{Name: h.name, Nodes: make([]NodeStats, 0, len(nodes))}
+	for _, n := range nodes {
+		stats.Nodes = append(stats.Nodes, n.stats())
+	}
+	return stats
+}
+
+// Stats 返回默认句柄的统计信息快照.
+func Stats() HandleStats {
+	return defaultHandle.Stats()
+}
+
+// AllStats 返回所有句柄的统计信息快照.
+func AllStats() []HandleStats {
+	hs := Handles()
+	stats := make([]HandleStats, 0, len(hs))
+	for _, h := range hs {
+		stats = append(stats, h.Stats())
+	}
+	return stats
+}
+
+// PublishExpvar 把 AllStats 发布为名字为 name 的 expvar 变量, 通过 /debug/vars 查看.
+// 和 expvar.Publish 一样, 重复的 name 会 panic.
+func PublishExpvar(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return AllStats()
+	}))
+}
+
+// WritePrometheus 把所有句柄的统计信息以 Prometheus 文本格式写到 w.
+func WritePrometheus(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	all := AllStats()
+
+	cacheMetrics := []struct {
+		name, typ, help string
+		value           func(s CacheStats) float64
+	}{
+		{"db_stmt_cache_size", "gauge", "Number of cached statements.", func(s CacheStats) float64 { return float64(s.Size) }},
+		{"db_stmt_cache_closing", "gauge", "Removed statements waiting for CloseDelay to be closed.", func(s CacheStats) float64 { return float64(s.Closing) }},
+		{"db_stmt_cache_hits_total", "counter", "Statement cache hits.", func(s CacheStats) float64 { return float64(s.Hits) }},
+		{"db_stmt_cache_misses_total", "counter", "Statement cache misses.", func(s CacheStats) float64 { return float64(s.Misses) }},
+		{"db_stmt_cache_evictions_total", "counter", "Statements removed from the cache.", func(s CacheStats) float64 { return float64(s.Evictions) }},
+		{"db_stmt_prepares_total", "counter", "Successful statement prepares.", func(s CacheStats) float64 { return float64(s.Prepares) }},
+		{"db_stmt_prepare_errors_total", "counter", "Failed statement prepares.", func(s CacheStats) float64 { return float64(s.PrepareErrors) }},
+		{"db_stmt_prepare_seconds_total", "counter", "Time spent preparing statements.", func(s CacheStats) float64 { return s.PrepareTime.Seconds() }},
+	}
+	for _, m := range cacheMetrics {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.typ)
+		eachCache(all, func(labels string, s CacheStats) {
+			fmt.Fprintf(bw, "%s{%s} %s\n", m.name, labels, formatFloat(m.value(s)))
+		})
+	}
+
+	// 按 Fingerprint 的命中次数使用累计值, Stmt 被淘汰之后不会减少, 可以用于 rate()
+	fmt.Fprintf(bw, "# HELP db_stmt_hits_total Cache hits per statement fingerprint.\n# TYPE db_stmt_hits_total counter\n")
+	eachCache(all, func(labels string, s CacheStats) {
+		fps := make([]string, 0, len(s.FingerprintHits))
+		for fp := range s.FingerprintHits {
+			fps = append(fps, fp)
+		}
+		sort.Strings(fps)
+		for _, fp := range fps {
+			fmt.Fprintf(bw, "db_stmt_hits_total{%s,fingerprint=%s} %d\n", labels, labelValue(fp), s.FingerprintHits[fp])
+		}
+	})
+
+	// 其他按 Fingerprint 的指标来自当前缓存的 Stmt, 都是 gauge
+	stmtMetrics := []struct {
+		name, typ, help string
+		value           func(s StmtStats) float64
+	}{
+		{"db_stmt_prepare_seconds", "gauge", "Maximum prepare latency per statement fingerprint.", func(s StmtStats) float64 { return s.PrepareTime.Seconds() }},
+		{"db_stmt_last_used_timestamp_seconds", "gauge", "Last use time per statement fingerprint.", func(s StmtStats) float64 { return float64(s.LastUsed.UnixNano()) / 1e9 }},
+	}
+	for _, m := range stmtMetrics {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.typ)
+		eachCache(all, func(labels string, s CacheStats) {
+			for _, e := range s.ByFingerprint() {
+				fmt.Fprintf(bw, "%s{%s,fingerprint=%s} %s\n", m.name, labels, labelValue(e.Fingerprint), formatFloat(m.value(e)))
+			}
+		})
+	}
+
+	return bw.Flush()
+}
+
+// MetricsHandler 返回以 Prometheus 文本格式输出统计信息的 http.Handler.
+func MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		WritePrometheus(w)
+	})
+}
+
+func eachCache(all []HandleStats, fn func(labels string, s CacheStats)) {
+	for _, hs := range all {
+		for _, ns := range hs.Nodes {
+			labels := "handle=" + labelValue(hs.Name) + ",node=" + labelValue(ns.Name)
+			fn(labels+`,kind="stmt"`, ns.Stmt)
+			fn(labels+`,kind="named"`, ns.NamedStmt)
+		}
+	}
+}
+
+var labelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelValue 返回加上引号的 Prometheus 标签值, 只转义反斜杠, 双引号和换行;
+// Go 的 %q 会输出 \u 和 \x 这样 Prometheus 不支持的转义.
+func labelValue(s string) string {
+	return `"` + labelReplacer.Replace(s) + `"`
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,107 @@
+package db
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestStatsByFingerprint(t *testing.T) {
+	d, _ := newFakeDB(t)
+	h := Use("test-stats")
+	h.SetDB(d)
+	defer h.CloseDB()
+
+	ctx := context.Background()
+	for _, q := range []string{
+		"SELECT * FROM t WHERE id IN (1, 2)",
+		"SELECT * FROM t WHERE id IN (3, 4, 5)",
+		"SELECT * FROM t WHERE id IN (3, 4, 5)",
+		"UPDATE t SET a=1",
+	} {
+		if _, err := h.ExecContext(ctx, q); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stmt := h.Stats().Nodes[0].Stmt
+	if len(stmt.Entries) != 3 {
+		t.Fatalf("entries = %d, want 3", len(stmt.Entries))
+	}
+	if fp := stmt.Entries[0].Fingerprint; fp != "update t set a = ?" {
+		t.Errorf("Fingerprint = %q", fp)
+	}
+	agg := stmt.ByFingerprint()
+	if len(agg) != 2 {
+		t.Fatalf("ByFingerprint returned %d entries, want 2", len(agg))
+	}
+	if agg[1].Fingerprint != "select * from t where id in (?+)" || agg[1].Hits != 1 {
+		t.Errorf("aggregated entry = %+v", agg[1])
+	}
+
+	var b strings.Builder
+	if err := WritePrometheus(&b); err != nil {
+		t.Fatal(err)
+	}
+	want := `db_stmt_hits_total{handle="test-stats",node="primary",kind="stmt",fingerprint="select * from t where id in (?+)"} 1`
+	if !strings.Contains(b.String(), want+"\n") {
+		t.Errorf("metrics do not contain %s:\n%s", want, b.String())
+	}
+	if n := strings.Count(b.String(), `db_stmt_hits_total{handle="test-stats"`); n != 2 {
+		t.Errorf("hits are not aggregated by fingerprint: %d series", n)
+	}
+}
+
+func TestStmtHitsSurviveEviction(t *testing.T) {
+	d, _ := newFakeDB(t)
+	h := Use("test-stats-evict")
+	h.SetDB(d)
+	h.SetCacheOptions(CacheOptions{MaxSize: 1})
+	defer h.CloseDB()
+
+	ctx := context.Background()
+	for _, q := range []string{"UPDATE t SET a=1", "UPDATE t SET a=2", "UPDATE t SET a=3", "DELETE FROM t"} {
+		if _, err := h.ExecContext(ctx, q); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stmt := h.Stats().Nodes[0].Stmt
+	if len(stmt.Entries) != 1 {
+		t.Fatalf("entries = %d, want 1", len(stmt.Entries))
+	}
+	if hits := stmt.FingerprintHits["update t set a = ?"]; hits != 0 {
+		t.Errorf("hits = %d before any cache hit", hits)
+	}
+
+	h.SetCacheOptions(CacheOptions{})
+	for i := 0; i < 3; i++ {
+		h.ExecContext(ctx, "UPDATE t SET a=1")
+	}
+	h.ExecContext(ctx, "UPDATE t SET a=2")
+	h.CloseAllStmt()
+
+	var b strings.Builder
+	if err := WritePrometheus(&b); err != nil {
+		t.Fatal(err)
+	}
+	want := `db_stmt_hits_total{handle="test-stats-evict",node="primary",kind="stmt",fingerprint="update t set a = ?"} 2`
+	if !strings.Contains(b.String(), want+"\n") {
+		t.Errorf("hits are lost after the stmts are closed, metrics do not contain %s:\n%s", want, b.String())
+	}
+}
+
+func TestLabelValue(t *testing.T) {
+	tests := []struct {
+		s, want string
+	}{
+		{`select "Col" from t`, `"select \"Col\" from t"`},
+		{"a\\b\nc", `"a\\b\nc"`},
+		{"select 名字 from t\t", "\"select 名字 from t\t\""},
+	}
+	for _, tt := range tests {
+		if got := labelValue(tt.s); got != tt.want {
+			t.Errorf("labelValue(%q) = %s, want %s", tt.s, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,429 @@
+package db
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// CacheOptions 设置 Stmt 缓存的容量和淘汰策略.
+type CacheOptions struct {
+	// MaxSize 缓存 Stmt 的最大数量, 超过后淘汰最久没有使用的 Stmt; <= 0 表示不限制.
+	MaxSize int
+
+	// IdleTimeout Stmt 超过这个时间没有被使用就会被淘汰; <= 0 表示不过期.
+	IdleTimeout time.Duration
+
+	// CloseDelay 被淘汰的 Stmt 延迟多久关闭, 只作用于 GetStmt 和 GetNamedStmt 返回过的 Stmt;
+	// 这些 Stmt 可能还在别的 goroutine 里使用, 而缓存无法知道调用者什么时候用完, 延迟关闭给它们留出时间.
+	// sql.Stmt 的 Close 会等待已经开始的 Exec/Query, 所以只需要覆盖拿到 Stmt 到开始执行之间的时间, 不宜太长:
+	// 打开的 Stmt 最多是 MaxSize 加上最近 CloseDelay 内被淘汰的这类 Stmt, 见 CacheStats.Closing.
+	// ExecContext 等函数和 AcquireStmt 使用的 Stmt 按照引用计数在最后一个使用者结束时关闭, 不需要延迟.
+	// <= 0 表示立即关闭.
+	CloseDelay time.Duration
+}
+
+// DefaultCacheOptions 是 Stmt 缓存的默认设置.
+var DefaultCacheOptions = CacheOptions{
+	MaxSize:    512,
+	CloseDelay: time.Second,
+}
+
+type cacheEntry struct {
+	query       string
+	fingerprint string    // 见 Fingerprint
+	stmt        io.Closer // *sqlx.Stmt or *sqlx.NamedStmt
+	created     time.Time
+	lastUsed    time.Time
+	prepareTime time.Duration
+	hits        int64
+	uses        int64 // 上次清理之后的使用次数, 用于 CleanLeastUsed
+
+	refs     int  // 正在使用的调用者数量, 见 acquire 和 release
+	borrowed bool // 通过 get 交给了不会调用 release 的调用者, 关闭时使用 CloseDelay
+	retired  bool // 已经从缓存中删除, refs 降为 0 时关闭
+}
+
+// prepareCall 是一次正在进行的 prepare, 同一个 query 的其他调用者等待它的结果.
+type prepareCall struct {
+	done  chan struct{}
+	entry *cacheEntry
+	err   error
+}
+
+// stmtCache 是 query 到 Stmt 的 LRU 缓存, 并发安全.
+type stmtCache struct {
+	mutex      sync.Mutex
+	opts       CacheOptions
+	driverName string                   // 用于计算 Fingerprint
+	ll         *list.List               // front 是最近使用的
+	items      map[string]*list.Element // map[query]*list.Element
+	pending    map[string]*prepareCall  // map[query]*prepareCall
+	closed     bool                     // 已经 close, 新创建的 Stmt 不再缓存, 最后一个使用者 release 之后关闭
+	closing    int                      // 已经淘汰, 等待 CloseDelay 之后关闭的 Stmt 数量
+
+	// 统计信息, 见 CacheStats
+	hits          int64
+	misses        int64
+	prepares      int64
+	prepareErrors int64
+	prepareTime   time.Duration
+	evictions     int64
+	fpHits        map[string]int64 // map[fingerprint]hits, 缓存项被删除之后仍然保留
+}
+
+func newStmtCache(driverName string, opts CacheOptions) *stmtCache {
+	return &stmtCache{
+		opts:       opts,
+		driverName: driverName,
+		ll:         list.New(),
+		items:      make(map[string]*list.Element),
+		pending:    make(map[string]*prepareCall),
+		fpHits:     make(map[string]int64),
+	}
+}
+
+// get 返回 query 对应的 Stmt, 没有缓存则调用 prepare 创建并缓存, 见 acquire.
+// 调用者不需要释放返回的 Stmt, 它被淘汰之后按照 CloseDelay 延迟关闭.
+func (c *stmtCache) get(ctx context.Context, query string, prepare func(ctx context.Context) (io.Closer, error)) (io.Closer, error) {
+	entry, err := c.acquire(ctx, query, prepare)
+	if err != nil {
+		return nil, err
+	}
+	c.mutex.Lock()
+	entry.borrowed = true
+	c.mutex.Unlock()
+	c.release(entry)
+	return entry.stmt, nil
+}
+
+// acquire 返回 query 对应的缓存项并增加它的引用计数, 没有缓存则调用 prepare 创建并缓存;
+// 使用完之后必须调用 release, 在此之前缓存项被淘汰也不会关闭它的 Stmt.
+//
+// 同一个 query 同时只有一个调用者执行 prepare, 其他调用者等待它的结果或者自己的 ctx 结束;
+// prepare 期间不持有 c.mutex, 不会阻塞其他 query.
+// 如果执行 prepare 的调用者因为自己的 ctx 结束而失败, 等待者会重新尝试.
+func (c *stmtCache) acquire(ctx context.Context, query string, prepare func(ctx context.Context) (io.Closer, error)) (*cacheEntry, error) {
+	for {
+		c.mutex.Lock()
+		if entry := c.getLocked(query); entry != nil {
+			c.hits++
+			entry.refs++
+			c.mutex.Unlock()
+			return entry, nil
+		}
+		c.misses++
+		call := c.pending[query]
+		if call == nil {
+			call = &prepareCall{done: make(chan struct{})}
+			c.pending[query] = call
+			c.mutex.Unlock()
+
+			c.doPrepare(ctx, query, call, prepare)
+			return call.entry, call.err
+		}
+		c.mutex.Unlock()
+
+		select {
+		case <-call.done:
+			if call.err != nil {
+				if isContextError(call.err) && ctx.Err() == nil {
+					continue
+				}
+				return nil, call.err
+			}
+			c.mutex.Lock()
+			if call.entry.retired {
+				// 刚创建就被淘汰了, 重新查找
+				c.mutex.Unlock()
+				continue
+			}
+			call.entry.refs++
+			c.mutex.Unlock()
+			return call.entry, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// acquireCached 同 acquire, 但是没有缓存时返回 nil 而不创建.
+func (c *stmtCache) acquireCached(query string) *cacheEntry {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry := c.getLocked(query)
+	if entry == nil {
+		return nil
+	}
+	c.hits++
+	entry.refs++
+	return entry
+}
+
+// release 减少 acquire 增加的引用计数, 已经被淘汰的缓存项没有使用者之后关闭.
+func (c *stmtCache) release(entry *cacheEntry) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry.refs--
+	if entry.retired && entry.refs == 0 {
+		c.closeEntry(entry)
+	}
+}
+
+func (c *stmtCache) doPrepare(ctx context.Context, query string, call *prepareCall, prepare func(ctx context.Context) (io.Closer, error)) {
+	start := time.Now()
+	var stmt io.Closer
+	defer func() {
+		prepareTime := time.Since(start)
+
+		c.mutex.Lock()
+		delete(c.pending, query)
+		c.prepareTime += prepareTime
+		if call.err == nil && stmt != nil {
+			c.prepares++
+			call.entry = c.addLocked(query, stmt, prepareTime)
+		} else {
+			c.prepareErrors++
+		}
+		c.mutex.Unlock()
+		close(call.done)
+	}()
+
+	call.err = errPreparePanic // prepare panic 时等待者得到这个错误
+	stmt, call.err = prepare(ctx)
+}
+
+// getLocked 返回 query 对应的缓存项, 没有缓存或者已经过期返回 nil, 调用者必须持有 c.mutex.
+func (c *stmtCache) getLocked(query string) *cacheEntry {
+	elem := c.items[query]
+	if elem == nil {
+		return nil
+	}
+	entry := elem.Value.(*cacheEntry)
+
+	now := time.Now()
+	if c.expired(entry, now) {
+		c.retire(c.removeElement(elem))
+		return nil
+	}
+	entry.lastUsed = now
+	entry.hits++
+	entry.uses++
+	c.fpHits[entry.fingerprint]++
+	c.ll.MoveToFront(elem)
+	return entry
+}
+
+// addLocked 缓存 query 对应的 Stmt 并返回引用计数为 1 的缓存项, 属于执行 prepare 的调用者;
+// 然后按照 MaxSize 和 IdleTimeout 淘汰旧的 Stmt. 调用者必须持有 c.mutex.
+func (c *stmtCache) addLocked(query string, stmt io.Closer, prepareTime time.Duration) *cacheEntry {
+	now := time.Now()
+	entry := &cacheEntry{
+		query:       query,
+		fingerprint: Fingerprint(c.driverName, query),
+		stmt:        stmt,
+		created:     now,
+		lastUsed:    now,
+		prepareTime: prepareTime,
+		refs:        1,
+	}
+	if _, ok := c.fpHits[entry.fingerprint]; !ok {
+		c.fpHits[entry.fingerprint] = 0 // 让计数器从第一次 prepare 开始出现
+	}
+	if c.closed {
+		// 所属的 node 已经被替换, 调用者在替换之前选中了它; 不缓存, release 之后关闭
+		entry.retired = true
+		return entry
+	}
+	if elem := c.items[query]; elem != nil {
+		c.retire(elem.Value.(*cacheEntry))
+		elem.Value = entry
+		c.ll.MoveToFront(elem)
+	} else {
+		c.items[query] = c.ll.PushFront(entry)
+	}
+	c.evict(now)
+	return entry
+}
+
+// remove 从缓存中删除并关闭 query 对应的 Stmt, 如果缓存的已经不是 stmt 则什么也不做.
+func (c *stmtCache) remove(query string, stmt io.Closer) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if elem := c.items[query]; elem != nil && elem.Value.(*cacheEntry).stmt == stmt {
+		c.retire(c.removeElement(elem))
+	}
+}
+
+// purge 删除所有缓存的 Stmt, 没有使用者的立即关闭, 其他的在最后一个使用者 release 之后关闭.
+func (c *stmtCache) purge() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.purgeLocked()
+}
+
+// close 同 purge, 并且之后创建的 Stmt 不再缓存, 在使用者 release 之后关闭; 用于被替换掉的 node,
+// 替换之前已经选中它的调用者仍然可以使用它, 但是不会留下没有人关闭的 Stmt.
+func (c *stmtCache) close() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.closed = true
+	c.purgeLocked()
+}
+
+func (c *stmtCache) purgeLocked() {
+	for _, elem := range c.items {
+		c.retire(elem.Value.(*cacheEntry))
+	}
+	c.ll.Init()
+	c.items = make(map[string]*list.Element)
+}
+
+// clean 按照 policy 关闭并删除缓存的 Stmt, 见 CleanerOptions.
+func (c *stmtCache) clean(opts CleanerOptions) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	switch opts.Policy {
+	case CleanIdle:
+		deadline := time.Now().Add(-opts.IdleTime)
+		for elem := c.ll.Back(); elem != nil; {
+			prev := elem.Prev()
+			if elem.Value.(*cacheEntry).lastUsed.Before(deadline) {
+				c.retire(c.removeElement(elem))
+			}
+			elem = prev
+		}
+	case CleanLeastUsed:
+		entries := make([]*cacheEntry, 0, c.ll.Len())
+		for elem := c.ll.Front(); elem != nil; elem = elem.Next() {
+			entries = append(entries, elem.Value.(*cacheEntry))
+		}
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i].uses < entries[j].uses })
+		for _, entry := range entries[:int(float64(len(entries))*opts.Fraction)] {
+			c.retire(c.removeElement(c.items[entry.query]))
+		}
+		for _, entry := range entries {
+			entry.uses = 0
+		}
+	default:
+		for elem := c.ll.Back(); elem != nil; elem = c.ll.Back() {
+			c.retire(c.removeElement(elem))
+		}
+	}
+}
+
+func (c *stmtCache) len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.ll.Len()
+}
+
+// stats 返回缓存的统计信息, Entries 按照最近使用的顺序排列.
+func (c *stmtCache) stats() CacheStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	stats := CacheStats{
+		Size:            c.ll.Len(),
+		MaxSize:         c.opts.MaxSize,
+		Hits:            c.hits,
+		Misses:          c.misses,
+		Prepares:        c.prepares,
+		PrepareErrors:   c.prepareErrors,
+		PrepareTime:     c.prepareTime,
+		Evictions:       c.evictions,
+		Closing:         c.closing,
+		Entries:         make([]StmtStats, 0, c.ll.Len()),
+		FingerprintHits: make(map[string]int64, len(c.fpHits)),
+	}
+	for fp, hits := range c.fpHits {
+		stats.FingerprintHits[fp] = hits
+	}
+	for elem := c.ll.Front(); elem != nil; elem = elem.Next() {
+		entry := elem.Value.(*cacheEntry)
+		stats.Entries = append(stats.Entries, StmtStats{
+			Fingerprint: entry.fingerprint,
+			Query:       entry.query,
+			Hits:        entry.hits,
+			PrepareTime: entry.prepareTime,
+			Created:     entry.created,
+			LastUsed:    entry.lastUsed,
+		})
+	}
+	return stats
+}
+
+func (c *stmtCache) setOptions(opts CacheOptions) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.opts = opts
+	c.evict(time.Now())
+}
+
+func (c *stmtCache) expired(entry *cacheEntry, now time.Time) bool {
+	return c.opts.IdleTimeout > 0 && now.Sub(entry.lastUsed) > c.opts.IdleTimeout
+}
+
+// evict 淘汰过期的 Stmt 以及超出 MaxSize 的最久没有使用的 Stmt, 调用者必须持有 c.mutex.
+func (c *stmtCache) evict(now time.Time) {
+	for elem := c.ll.Back(); elem != nil; elem = c.ll.Back() {
+		entry := elem.Value.(*cacheEntry)
+		if !c.expired(entry, now) && (c.opts.MaxSize <= 0 || c.ll.Len() <= c.opts.MaxSize) {
+			return
+		}
+		c.retire(c.removeElement(elem))
+	}
+}
+
+// removeElement 从缓存中删除 elem 并返回它的缓存项, 调用者负责 retire; 计入淘汰次数.
+func (c *stmtCache) removeElement(elem *list.Element) *cacheEntry {
+	entry := c.ll.Remove(elem).(*cacheEntry)
+	delete(c.items, entry.query)
+	c.evictions++
+	return entry
+}
+
+// retire 标记已经从缓存中删除的缓存项, 没有使用者时立即关闭它的 Stmt. 调用者必须持有 c.mutex.
+func (c *stmtCache) retire(entry *cacheEntry) {
+	if entry.retired {
+		return
+	}
+	entry.retired = true
+	if entry.refs == 0 {
+		c.closeEntry(entry)
+	}
+}
+
+// closeEntry 关闭缓存项的 Stmt; GetStmt 返回过的 Stmt 如果设置了 CloseDelay 则延迟关闭. 调用者必须持有 c.mutex.
+//
+// sql.Stmt 的 Close 会等待正在执行的 Exec/Query 结束, 所以只需要照顾拿到了 Stmt 但还没有开始执行的调用者.
+func (c *stmtCache) closeEntry(entry *cacheEntry) {
+	stmt := entry.stmt
+	if !entry.borrowed || c.opts.CloseDelay <= 0 {
+		stmt.Close()
+		return
+	}
+	c.closing++
+	time.AfterFunc(c.opts.CloseDelay, func() {
+		stmt.Close()
+
+		c.mutex.Lock()
+		c.closing--
+		c.mutex.Unlock()
+	})
+}
+
+var errPreparePanic = errors.New("db: prepare panicked")
+
+func isContextError(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
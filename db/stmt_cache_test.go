@@ -0,0 +1,228 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type fakeStmt struct {
+	query  string
+	closed int32
+}
+
+func (s *fakeStmt) Close() error {
+	atomic.AddInt32(&s.closed, 1)
+	return nil
+}
+
+func (s *fakeStmt) isClosed() bool {
+	return atomic.LoadInt32(&s.closed) > 0
+}
+
+// prepareFake 返回创建 fakeStmt 的 prepare 函数, 创建的 Stmt 按 query 记录在 stmts 中.
+func prepareFake(stmts map[string]*fakeStmt, query string) func(ctx context.Context) (io.Closer, error) {
+	return func(ctx context.Context) (io.Closer, error) {
+		s := &fakeStmt{query: query}
+		stmts[query] = s
+		return s, nil
+	}
+}
+
+func TestStmtCacheLRU(t *testing.T) {
+	c := newStmtCache("", CacheOptions{MaxSize: 2})
+	stmts := make(map[string]*fakeStmt)
+	ctx := context.Background()
+
+	for _, q := range []string{"a", "b", "a", "c"} {
+		if _, err := c.get(ctx, q, prepareFake(stmts, q)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !stmts["b"].isClosed() {
+		t.Error("least recently used b is not evicted")
+	}
+	if stmts["a"].isClosed() || stmts["c"].isClosed() {
+		t.Error("recently used stmts are closed")
+	}
+	stats := c.stats()
+	if stats.Size != 2 || stats.Hits != 1 || stats.Misses != 3 || stats.Evictions != 1 {
+		t.Errorf("stats = %+v", stats)
+	}
+	if stats.Entries[0].Query != "c" || stats.Entries[1].Query != "a" {
+		t.Errorf("entries not in LRU order: %+v", stats.Entries)
+	}
+}
+
+func TestStmtCacheIdleTimeout(t *testing.T) {
+	c := newStmtCache("", CacheOptions{IdleTimeout: time.Millisecond})
+	stmts := make(map[string]*fakeStmt)
+	ctx := context.Background()
+
+	c.get(ctx, "a", prepareFake(stmts, "a"))
+	first := stmts["a"]
+	time.Sleep(5 * time.Millisecond)
+	c.get(ctx, "a", prepareFake(stmts, "a"))
+
+	if !first.isClosed() || stmts["a"] == first {
+		t.Error("expired stmt is not replaced")
+	}
+}
+
+func TestStmtCacheRefCount(t *testing.T) {
+	c := newStmtCache("", CacheOptions{MaxSize: 1})
+	stmts := make(map[string]*fakeStmt)
+	ctx := context.Background()
+
+	entry, err := c.acquire(ctx, "a", prepareFake(stmts, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.get(ctx, "b", prepareFake(stmts, "b"))
+	if stmts["a"].isClosed() {
+		t.Fatal("evicted stmt is closed while still acquired")
+	}
+	c.release(entry)
+	if !stmts["a"].isClosed() {
+		t.Fatal("evicted stmt is not closed after release")
+	}
+
+	entry, _ = c.acquire(ctx, "b", prepareFake(stmts, "b"))
+	c.purge()
+	if stmts["b"].isClosed() {
+		t.Fatal("purge closed a stmt still in use")
+	}
+	c.release(entry)
+	if !stmts["b"].isClosed() {
+		t.Fatal("purged stmt is not closed after release")
+	}
+}
+
+func TestStmtCacheCloseDelay(t *testing.T) {
+	c := newStmtCache("", CacheOptions{MaxSize: 1, CloseDelay: 20 * time.Millisecond})
+	stmts := make(map[string]*fakeStmt)
+	ctx := context.Background()
+
+	// get 返回的 Stmt 无法跟踪使用者, 淘汰后延迟关闭
+	c.get(ctx, "a", prepareFake(stmts, "a"))
+	// acquire 的 Stmt 在 release 之后立即关闭
+	entry, _ := c.acquire(ctx, "b", prepareFake(stmts, "b"))
+	c.release(entry)
+	c.get(ctx, "c", prepareFake(stmts, "c"))
+
+	if stmts["a"].isClosed() {
+		t.Error("borrowed stmt is closed before CloseDelay")
+	}
+	if !stmts["b"].isClosed() {
+		t.Error("released stmt is not closed immediately")
+	}
+	if stats := c.stats(); stats.Size != 1 || stats.Closing != 1 {
+		t.Errorf("size = %d, closing = %d, want 1, 1", stats.Size, stats.Closing)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if !stmts["a"].isClosed() {
+		t.Error("borrowed stmt is not closed after CloseDelay")
+	}
+	if closing := c.stats().Closing; closing != 0 {
+		t.Errorf("closing = %d after CloseDelay", closing)
+	}
+}
+
+func TestStmtCacheSingleFlight(t *testing.T) {
+	c := newStmtCache("", DefaultCacheOptions)
+	var prepares int32
+	start := make(chan struct{})
+	prepare := func(ctx context.Context) (io.Closer, error) {
+		atomic.AddInt32(&prepares, 1)
+		<-start
+		return &fakeStmt{}, nil
+	}
+
+	var wg sync.WaitGroup
+	results := make([]io.Closer, 10)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			stmt, err := c.get(context.Background(), "q", prepare)
+			if err != nil {
+				t.Error(err)
+			}
+			results[i] = stmt
+		}(i)
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(start)
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&prepares); n != 1 {
+		t.Errorf("prepared %d times, want 1", n)
+	}
+	for _, stmt := range results {
+		if stmt != results[0] {
+			t.Fatal("callers got different stmts")
+		}
+	}
+}
+
+func TestStmtCacheLeaderCanceled(t *testing.T) {
+	c := newStmtCache("", DefaultCacheOptions)
+	started := make(chan struct{})
+	leaderCtx, cancel := context.WithCancel(context.Background())
+
+	go c.get(leaderCtx, "q", func(ctx context.Context) (io.Closer, error) {
+		close(started)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	<-started
+
+	done := make(chan error)
+	go func() {
+		_, err := c.get(context.Background(), "q", func(ctx context.Context) (io.Closer, error) {
+			return &fakeStmt{}, nil
+		})
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+
+	if err := <-done; err != nil {
+		t.Fatalf("waiter got the leader's error: %v", err)
+	}
+}
+
+func TestStmtCachePrepareError(t *testing.T) {
+	c := newStmtCache("", DefaultCacheOptions)
+	errPrepare := errors.New("syntax error")
+	fail := func(ctx context.Context) (io.Closer, error) { return nil, errPrepare }
+
+	if _, err := c.get(context.Background(), "q", fail); err != errPrepare {
+		t.Fatalf("err = %v", err)
+	}
+	if c.len() != 0 {
+		t.Error("failed prepare is cached")
+	}
+	if stats := c.stats(); stats.PrepareErrors != 1 {
+		t.Errorf("PrepareErrors = %d", stats.PrepareErrors)
+	}
+}
+
+func TestStmtCacheClean(t *testing.T) {
+	c := newStmtCache("", CacheOptions{})
+	stmts := make(map[string]*fakeStmt)
+	ctx := context.Background()
+
+	for _, q := range []string{"a", "b", "b", "c", "c", "c", "d", "d", "d", "d"} {
+		c.get(ctx, q, prepareFake(stmts, q))
+	}
+	c.clean(CleanerOptions{Policy: CleanLeastUsed, Fraction: 0.5})
+	if !stmts["a"].isClosed() || !stmts["b"].isClosed() || stmts["c"].isClosed() || stmts["d"].isClosed() {
+		t.Error("CleanLeastUsed did not remove the least used half")
+	}
+}
@@ -0,0 +1,273 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/aiyi/go/db/internal/driverutil"
+	"github.com/jmoiron/sqlx"
+)
+
+// ErrNoTenant 表示 context 中没有租户 ID, 见 WithTenant.
+var ErrNoTenant = errors.New("db: no tenant in context")
+
+type tenantKey struct{}
+
+// WithTenant 返回保存了租户 ID 的 context, Tenants.Handle 根据它选择租户的句柄.
+func WithTenant(ctx context.Context, tenantID string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenantID)
+}
+
+// TenantFromContext 返回 WithTenant 保存的租户 ID.
+func TenantFromContext(ctx context.Context) (string, bool) {
+	tenantID, ok := ctx.Value(tenantKey{}).(string)
+	return tenantID, ok && tenantID != ""
+}
+
+// TenantOptions 设置 Tenants 如何创建和回收租户的句柄.
+type TenantOptions struct {
+	// Open 创建租户的数据库, 返回的 sqlx.DB 由 Tenants 负责关闭.
+	// 每个 schema 一个租户时可以使用 SchemaOpener.
+	Open func(tenantID string) (*sqlx.DB, error)
+
+	// Setup 在租户的句柄创建之后调用, 可以在这里设置 Hook, 熔断器等; 可以为 nil.
+	Setup func(tenantID string, h *Handle)
+
+	// CacheOptions 是租户句柄的 Stmt 缓存设置, 为 nil 时使用 DefaultCacheOptions.
+	CacheOptions *CacheOptions
+
+	// IdleTimeout 租户超过这个时间没有使用时关闭它的句柄, 默认 10 分钟.
+	IdleTimeout time.Duration
+
+	// ShutdownTimeout 回收租户句柄时等待正在进行的操作的时间, 默认 30 秒, 见 Handle.Shutdown.
+	ShutdownTimeout time.Duration
+}
+
+type tenantHandle struct {
+	h        *Handle
+	lastUsed time.Time
+}
+
+// Tenants 管理每个租户一个的数据库句柄, 使用 NewTenants 创建.
+//
+// 每个租户的句柄有自己的 sqlx.DB 和 Stmt 缓存, 同样的 query 在不同租户的 schema 上创建的 Stmt 不会共用;
+// 租户的句柄不会出现在 Use 和 Handles 中.
+type Tenants struct {
+	opts TenantOptions
+
+	mutex   sync.Mutex
+	handles map[string]*tenantHandle // map[tenantID]*tenantHandle
+	closed  bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func NewTenants(opts TenantOptions) *Tenants {
+	if opts.IdleTimeout <= 0 {
+		opts.IdleTimeout = time.Minute * 10
+	}
+	if opts.ShutdownTimeout <= 0 {
+		opts.ShutdownTimeout = time.Second * 30
+	}
+	t := &Tenants{
+		opts:    opts,
+		handles: make(map[string]*tenantHandle),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go t.reap()
+	return t
+}
+
+// Handle 返回 ctx 中的租户的句柄, 没有租户 ID 时返回 ErrNoTenant.
+//
+//	h, err := tenants.Handle(db.WithTenant(ctx, tenantID))
+//	if err != nil {
+//		return err
+//	}
+//	err = h.SelectContext(ctx, &orders, "SELECT * FROM orders WHERE user_id=?", userID)
+func (t *Tenants) Handle(ctx context.Context) (*Handle, error) {
+	tenantID, ok := TenantFromContext(ctx)
+	if !ok {
+		return nil, ErrNoTenant
+	}
+	return t.Get(tenantID)
+}
+
+// Get 返回租户的句柄, 第一次使用时通过 TenantOptions.Open 创建.
+func (t *Tenants) Get(tenantID string) (*Handle, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.closed {
+		return nil, ErrShutdown
+	}
+	if th := t.handles[tenantID]; th != nil {
+		th.lastUsed = time.Now()
+		return th.h, nil
+	}
+
+	// 在锁内创建, 避免同一个租户创建多个连接池; Open 通常不会访问网络.
+	d, err := t.opts.Open(tenantID)
+	if err != nil {
+		return nil, err
+	}
+	h := newHandle("tenant:" + tenantID)
+	h.SetDB(d)
+	if t.opts.CacheOptions != nil {
+		h.SetCacheOptions(*t.opts.CacheOptions)
+	}
+	if t.opts.Setup != nil {
+		t.opts.Setup(tenantID, h)
+	}
+	t.handles[tenantID] = &tenantHandle{h: h, lastUsed: time.Now()}
+	return h, nil
+}
+
+// Len 返回当前打开的租户句柄数量.
+func (t *Tenants) Len() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return len(t.handles)
+}
+
+// reap 周期性地关闭空闲的租户句柄.
+func (t *Tenants) reap() {
+	defer close(t.done)
+
+	ticker := time.NewTicker(t.opts.IdleTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			t.evictIdle(time.Now().Add(-t.opts.IdleTimeout))
+		case <-t.stop:
+			return
+		}
+	}
+}
+
+// evictIdle 关闭 deadline 之后没有使用过并且没有正在进行的操作的租户句柄.
+func (t *Tenants) evictIdle(deadline time.Time) {
+	var idle []*Handle
+
+	t.mutex.Lock()
+	for tenantID, th := range t.handles {
+		if th.lastUsed.Before(deadline) && th.h.InFlight() == 0 {
+			idle = append(idle, th.h)
+			delete(t.handles, tenantID)
+		}
+	}
+	t.mutex.Unlock()
+
+	for _, h := range idle {
+		t.shutdown(h)
+	}
+}
+
+func (t *Tenants) shutdown(h *Handle) error {
+	ctx, cancel := context.WithTimeout(context.Background(), t.opts.ShutdownTimeout)
+	defer cancel()
+	return h.Shutdown(ctx)
+}
+
+// Close 停止回收并关闭所有租户的句柄, 之后 Get 返回 ErrShutdown.
+func (t *Tenants) Close() (err error) {
+	t.mutex.Lock()
+	if t.closed {
+		t.mutex.Unlock()
+		return nil
+	}
+	t.closed = true
+	handles := t.handles
+	t.handles = make(map[string]*tenantHandle)
+	t.mutex.Unlock()
+
+	close(t.stop)
+	<-t.done
+
+	for _, th := range handles {
+		if e := t.shutdown(th.h); e != nil && err == nil {
+			err = e
+		}
+	}
+	return
+}
+
+var schemaNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+// SchemaOpener 返回用于 TenantOptions.Open 的函数, 适用于每个租户一个 schema 的场景:
+// 每个租户使用同一个 dsn 的独立连接池, 每个新连接建立后执行 fmt.Sprintf(initFormat, tenantID), 比如
+//
+//	db.SchemaOpener("mysql", dsn, "USE `tenant_%s`", nil)
+//	db.SchemaOpener("postgres", dsn, `SET search_path TO "tenant_%s"`, nil)
+//
+// 租户 ID 只能包含字母, 数字和下划线. configure 用于设置连接池参数, 可以为 nil.
+func SchemaOpener(driverName, dsn, initFormat string, configure func(d *sqlx.DB)) func(tenantID string) (*sqlx.DB, error) {
+	return func(tenantID string) (*sqlx.DB, error) {
+		if !schemaNameRegexp.MatchString(tenantID) {
+			return nil, fmt.Errorf("db: invalid tenant id %q", tenantID)
+		}
+
+		connector, err := driverutil.OpenConnector(driverName, dsn)
+		if err != nil {
+			return nil, err
+		}
+		d := sqlx.NewDb(sql.OpenDB(&initConnector{
+			connector: connector,
+			init:      fmt.Sprintf(initFormat, tenantID),
+		}), driverName)
+		if configure != nil {
+			configure(d)
+		}
+		return d, nil
+	}
+}
+
+// initConnector 在每个新连接建立后执行 init 语句.
+type initConnector struct {
+	connector driver.Connector
+	init      string
+}
+
+func (c *initConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = execConn(ctx, conn, c.init); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (c *initConnector) Driver() driver.Driver {
+	return c.connector.Driver()
+}
+
+func execConn(ctx context.Context, conn driver.Conn, query string) error {
+	if execer, ok := conn.(driver.ExecerContext); ok {
+		_, err := execer.ExecContext(ctx, query, nil)
+		if err != driver.ErrSkip {
+			return err
+		}
+	}
+
+	stmt, err := conn.Prepare(query)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(nil)
+	return err
+}
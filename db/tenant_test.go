@@ -0,0 +1,160 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+func newTestTenants(t *testing.T) (*Tenants, map[string]int) {
+	opened := make(map[string]int)
+	tenants := NewTenants(TenantOptions{
+		Open: func(tenantID string) (*sqlx.DB, error) {
+			if tenantID == "bad" {
+				return nil, errors.New("no such tenant")
+			}
+			opened[tenantID]++
+			d, _ := newFakeDB(t)
+			return d, nil
+		},
+		IdleTimeout: time.Hour,
+	})
+	t.Cleanup(func() {
+		tenants.Close()
+	})
+	return tenants, opened
+}
+
+func TestTenantsGet(t *testing.T) {
+	tenants, opened := newTestTenants(t)
+
+	if _, err := tenants.Handle(context.Background()); err != ErrNoTenant {
+		t.Errorf("no tenant: err = %v", err)
+	}
+	if len(opened) != 0 {
+		t.Error("tenant is opened before use")
+	}
+
+	a, err := tenants.Handle(WithTenant(context.Background(), "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := tenants.Get("a"); again != a {
+		t.Error("tenant handle is not cached")
+	}
+	if b, _ := tenants.Get("b"); b == a {
+		t.Error("tenants share a handle")
+	}
+	if opened["a"] != 1 || opened["b"] != 1 || tenants.Len() != 2 {
+		t.Errorf("opened = %v, Len = %d", opened, tenants.Len())
+	}
+	if _, err := tenants.Get("bad"); err == nil || tenants.Len() != 2 {
+		t.Errorf("failed open: err = %v, Len = %d", err, tenants.Len())
+	}
+}
+
+func TestTenantsEvictIdle(t *testing.T) {
+	tenants, opened := newTestTenants(t)
+	ctx := context.Background()
+
+	a, _ := tenants.Get("a")
+	busy, _ := tenants.Get("b")
+	_, release, err := busy.AcquireStmt(ctx, "UPDATE t SET a=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tenants.evictIdle(time.Now().Add(time.Second))
+	if tenants.Len() != 1 {
+		t.Fatalf("Len = %d, want 1", tenants.Len())
+	}
+	if _, err := a.ExecContext(ctx, "UPDATE t SET a=1"); err != ErrShutdown {
+		t.Errorf("evicted handle: err = %v, want ErrShutdown", err)
+	}
+	if again, _ := tenants.Get("b"); again != busy {
+		t.Error("tenant with operations in flight is evicted")
+	}
+
+	release()
+	if again, _ := tenants.Get("a"); again == a || opened["a"] != 2 {
+		t.Error("evicted tenant is not reopened")
+	}
+}
+
+func TestTenantsClose(t *testing.T) {
+	tenants, _ := newTestTenants(t)
+	a, _ := tenants.Get("a")
+
+	if err := tenants.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.ExecContext(context.Background(), "UPDATE t SET a=1"); err != ErrShutdown {
+		t.Errorf("closed handle: err = %v, want ErrShutdown", err)
+	}
+	if _, err := tenants.Get("a"); err != ErrShutdown {
+		t.Errorf("Get after Close: err = %v, want ErrShutdown", err)
+	}
+	if err := tenants.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+}
+
+func TestSchemaOpener(t *testing.T) {
+	open := SchemaOpener("fakedb", "", "USE `tenant_%s`", func(d *sqlx.DB) {
+		d.SetMaxIdleConns(2)
+	})
+	if _, err := open("a;DROP"); err == nil {
+		t.Error("invalid tenant id: no error")
+	}
+
+	d, err := open("s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if d.DriverName() != "fakedb" {
+		t.Errorf("DriverName = %q", d.DriverName())
+	}
+
+	// 每个新连接都执行一次 init 语句
+	ctx := context.Background()
+	c1, err := d.Connx(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := d.Connx(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c1.Close()
+	c2.Close()
+	if n := registeredFake.count("exec USE `tenant_s1`"); n != 2 {
+		t.Errorf("init executed %d times, want 2", n)
+	}
+	c3, _ := d.Connx(ctx)
+	c3.Close()
+	if n := registeredFake.count("exec USE `tenant_s1`"); n != 2 {
+		t.Errorf("init executed %d times on reused connections, want 2", n)
+	}
+
+	// init 语句失败时连接不可用
+	errInit := errors.New("unknown database")
+	registeredFake.setFail(func(op, query string) error {
+		if op == "exec" && query == "USE `tenant_s2`" {
+			return errInit
+		}
+		return nil
+	})
+	defer registeredFake.setFail(nil)
+	d2, err := open("s2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d2.Close()
+	if err := d2.PingContext(ctx); !errors.Is(err, errInit) {
+		t.Errorf("failed init: err = %v", err)
+	}
+}
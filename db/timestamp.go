@@ -0,0 +1,68 @@
+package db
+
+import (
+	"sync"
+	"time"
+)
+
+var (
+	timestampRWMutex sync.RWMutex
+	createdColumn    = "created"
+	modifiedColumn   = "modified"
+	clock            = time.Now
+)
+
+// SetTimestampColumns 设置按照列名自动填写时间的创建时间列和修改时间列, 默认是 created 和 modified, 为空表示不填写.
+// 这两列和带 autoCreateTime, autoUpdateTime 选项的字段一样处理: 创建时间列同 autoCreateTime, 修改时间列同 autoUpdateTime.
+func SetTimestampColumns(created, modified string) {
+	timestampRWMutex.Lock()
+	defer timestampRWMutex.Unlock()
+	createdColumn, modifiedColumn = created, modified
+}
+
+// SetClock 设置自动填写时间时使用的时钟, 用于测试; nil 表示使用 time.Now(默认).
+// 单位为 time 的字段直接使用 now() 的返回值, 需要 UTC 时间时可以设置 func() time.Time { return time.Now().UTC() }.
+func SetClock(now func() time.Time) {
+	timestampRWMutex.Lock()
+	defer timestampRWMutex.Unlock()
+	if now == nil {
+		now = time.Now
+	}
+	clock = now
+}
+
+// timestamps 是生成一条语句时使用的自动时间设置.
+type timestamps struct {
+	created  string
+	modified string
+	now      time.Time
+}
+
+func getTimestamps() timestamps {
+	timestampRWMutex.RLock()
+	defer timestampRWMutex.RUnlock()
+	return timestamps{created: createdColumn, modified: modifiedColumn, now: clock()}
+}
+
+// onCreate 判断插入时是否自动填写字段 f 的时间.
+func (ts timestamps) onCreate(f *fieldInfo) bool {
+	return f.autoCreateTime || f.autoUpdateTime || f.column == ts.created || f.column == ts.modified
+}
+
+// onUpdate 判断更新时是否自动填写字段 f 的时间.
+func (ts timestamps) onUpdate(f *fieldInfo) bool {
+	return f.autoUpdateTime || f.column == ts.modified && !f.autoCreateTime
+}
+
+// value 返回字段 f 的单位的当前时间: unix 秒, milli 毫秒, nano 纳秒, time 是 time.Time.
+func (ts timestamps) value(f *fieldInfo) interface{} {
+	switch f.timeUnit {
+	case "milli":
+		return ts.now.UnixNano() / int64(time.Millisecond)
+	case "nano":
+		return ts.now.UnixNano()
+	case "time":
+		return ts.now
+	}
+	return ts.now.Unix()
+}
@@ -0,0 +1,118 @@
+package db
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// setClock 把时钟固定为 now, 测试结束时恢复.
+func setClock(t *testing.T, now time.Time) {
+	SetClock(func() time.Time { return now })
+	t.Cleanup(func() {
+		SetClock(nil)
+	})
+}
+
+func TestAutoTimeUnits(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 6000000, time.UTC)
+	setClock(t, now)
+
+	type row struct {
+		Name  string    `db:"name"`
+		Unix  int64     `db:"unix_at,autoCreateTime"`
+		Milli int64     `db:"milli_at,autoCreateTime:milli"`
+		Nano  int64     `db:"nano_at,autoUpdateTime:nano"`
+		Time  time.Time `db:"time_at,autoUpdateTime"`
+	}
+	query, args, err := BuildInsert("rows", &row{Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "INSERT INTO rows (name, unix_at, milli_at, nano_at, time_at) VALUES (?, ?, ?, ?, ?)"; query != want {
+		t.Errorf("query = %q, want %q", query, want)
+	}
+	want := []interface{}{"a", now.Unix(), now.UnixNano() / int64(time.Millisecond), now.UnixNano(), now}
+	if !reflect.DeepEqual(args, want) {
+		t.Errorf("args = %v, want %v", args, want)
+	}
+}
+
+func TestAutoTimeUpdate(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	setClock(t, now)
+
+	type patch struct {
+		Name      *string `db:"name"`
+		CreatedAt int64   `db:"created_at,autoCreateTime"`
+		UpdatedAt int64   `db:"updated_at,autoUpdateTime:milli"`
+	}
+	name := "a"
+	query, args, err := BuildUpdate("rows", &patch{Name: &name}, new(Filter).Where("id = ?", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "UPDATE rows SET name=?, updated_at=? WHERE (id = ?)"; query != want {
+		t.Errorf("query = %q, want %q", query, want)
+	}
+	if !reflect.DeepEqual(args, []interface{}{"a", now.UnixNano() / int64(time.Millisecond), 1}) {
+		t.Errorf("args = %v", args)
+	}
+
+	// 只有自动填写的列时没有需要更新的内容
+	if _, _, err := BuildUpdate("rows", &patch{}, new(Filter).Where("id = ?", 1)); err != ErrNothingToUpdate {
+		t.Errorf("err = %v, want ErrNothingToUpdate", err)
+	}
+}
+
+func TestSetTimestampColumns(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	setClock(t, now)
+
+	type row struct {
+		Name     string `db:"name"`
+		Created  int64  `db:"created"`
+		Modified int64  `db:"modified"`
+		AddTime  int64  `db:"add_time"`
+	}
+	query, args, err := BuildInsert("rows", &row{Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "INSERT INTO rows (name, created, modified, add_time) VALUES (?, ?, ?, ?)"; query != want {
+		t.Errorf("query = %q, want %q", query, want)
+	}
+	if !reflect.DeepEqual(args, []interface{}{"a", now.Unix(), now.Unix(), int64(0)}) {
+		t.Errorf("default columns: args = %v", args)
+	}
+
+	SetTimestampColumns("add_time", "")
+	t.Cleanup(func() {
+		SetTimestampColumns("created", "modified")
+	})
+	if _, args, err = BuildInsert("rows", &row{Name: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(args, []interface{}{"a", int64(0), int64(0), now.Unix()}) {
+		t.Errorf("custom columns: args = %v", args)
+	}
+}
+
+func TestAutoTimeUnknownUnit(t *testing.T) {
+	type row struct {
+		Name      string `db:"name"`
+		CreatedAt int64  `db:"created_at,autoCreateTime:hour"`
+	}
+	if _, _, err := BuildInsert("rows", &row{Name: "a"}); err == nil {
+		t.Error("unknown time unit: no error")
+	}
+	name := "a"
+	type patch struct {
+		Name      *string `db:"name"`
+		UpdatedAt int64   `db:"updated_at,autoUpdateTime:hour"`
+	}
+	if _, err := newHandle("test").Update(context.Background(), "rows", &patch{Name: &name}, new(Filter).Where("id = ?", 1)); err == nil {
+		t.Error("unknown time unit in update: no error")
+	}
+}
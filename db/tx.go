@@ -0,0 +1,172 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Tx 是 WithTx 中使用的事务, GetStmt 和 GetNamedStmt 返回绑定到这个事务上的 Stmt.
+// 事务总是在主库上执行.
+type Tx struct {
+	*sqlx.Tx
+
+	ctx   context.Context
+	n     *node // 开启事务时的主库
+	depth int   // savepoint 的嵌套层数, 最外层的事务是 0
+	stmts *txStmts
+}
+
+// txStmts 是绑定到事务上的 Stmt, 嵌套的 Tx 共享; 事务结束时 database/sql 会关闭它们.
+type txStmts struct {
+	stmts      map[string]*sqlx.Stmt      // map[query]*sqlx.Stmt
+	namedStmts map[string]*sqlx.NamedStmt // map[query]*sqlx.NamedStmt
+	releases   []func()                   // 释放绑定到事务上的缓存 Stmt
+}
+
+// release 在事务结束之后释放引用的缓存 Stmt.
+func (s *txStmts) release() {
+	for _, release := range s.releases {
+		release()
+	}
+	s.releases = nil
+}
+
+// WithTx 在主库上开启事务并执行 fn.
+// fn 返回 nil 时提交事务, 返回错误或者 panic 时回滚事务; panic 会在回滚之后继续向上传递.
+//
+//	err := db.WithTx(ctx, nil, func(tx *db.Tx) error {
+//		stmt, err := tx.GetStmt("UPDATE account SET balance=balance-? WHERE id=?")
+//		if err != nil {
+//			return err
+//		}
+//		_, err = stmt.Exec(amount, id)
+//		return err
+//	})
+func (h *Handle) WithTx(ctx context.Context, opts *sql.TxOptions, fn func(tx *Tx) error) (err error) {
+	if err = h.enter(); err != nil {
+		return
+	}
+	defer h.leave()
+
+	done, err := h.guard(ctx)
+	if err != nil {
+		return
+	}
+	var dbErr error // 计入熔断器的错误, fn 返回的错误不计入
+	defer func() {
+		done(dbErr)
+	}()
+
+	n := h.primaryNode()
+	sqlTx, err := n.db.BeginTxx(ctx, opts)
+	if err != nil {
+		dbErr = err
+		return
+	}
+
+	tx := &Tx{
+		Tx:  sqlTx,
+		ctx: ctx,
+		n:   n,
+		stmts: &txStmts{
+			stmts:      make(map[string]*sqlx.Stmt),
+			namedStmts: make(map[string]*sqlx.NamedStmt),
+		},
+	}
+	defer tx.stmts.release()
+
+	defer func() {
+		if p := recover(); p != nil {
+			sqlTx.Rollback()
+			dbErr = fmt.Errorf("db: panic in transaction: %v", p) // 事务没有完成, 计为失败
+			panic(p)
+		}
+	}()
+
+	if err = fn(tx); err != nil {
+		sqlTx.Rollback()
+		return
+	}
+	err = sqlTx.Commit()
+	dbErr = err
+	return
+}
+
+// WithTx 在当前事务中创建 savepoint 并执行 fn, 实现嵌套事务.
+// fn 返回 nil 时释放 savepoint, 返回错误或者 panic 时回滚到 savepoint, 外层事务不受影响.
+func (tx *Tx) WithTx(fn func(tx *Tx) error) (err error) {
+	savepoint := fmt.Sprintf("sp_%d", tx.depth+1)
+	if _, err = tx.Tx.ExecContext(tx.ctx, "SAVEPOINT "+savepoint); err != nil {
+		return
+	}
+
+	nested := *tx
+	nested.depth++
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Tx.ExecContext(tx.ctx, "ROLLBACK TO SAVEPOINT "+savepoint)
+			panic(p)
+		}
+	}()
+
+	if err = fn(&nested); err != nil {
+		tx.Tx.ExecContext(tx.ctx, "ROLLBACK TO SAVEPOINT "+savepoint)
+		return
+	}
+	_, err = tx.Tx.ExecContext(tx.ctx, "RELEASE SAVEPOINT "+savepoint)
+	return
+}
+
+// Context 返回开启事务时的 context.
+func (tx *Tx) Context() context.Context {
+	return tx.ctx
+}
+
+// GetStmt 返回绑定到事务上的 query 对应的 Stmt.
+// Handle 主库的缓存中有 query 对应的 Stmt 时绑定它, 否则直接在事务的连接上创建, 不会占用连接池中的其他连接.
+func (tx *Tx) GetStmt(query string) (*sqlx.Stmt, error) {
+	if stmt := tx.stmts.stmts[query]; stmt != nil {
+		return stmt, nil
+	}
+
+	var txStmt *sqlx.Stmt
+	if entry := tx.n.stmtSet.acquireCached(query); entry != nil {
+		txStmt = tx.StmtxContext(tx.ctx, entry.stmt.(*sqlx.Stmt))
+		tx.stmts.releases = append(tx.stmts.releases, func() { tx.n.stmtSet.release(entry) })
+	} else {
+		var err error
+		if txStmt, err = tx.PreparexContext(tx.ctx, query); err != nil {
+			return nil, err
+		}
+	}
+	tx.stmts.stmts[query] = txStmt
+	return txStmt, nil
+}
+
+// GetNamedStmt 返回绑定到事务上的 query 对应的 NamedStmt, 规则同 GetStmt.
+func (tx *Tx) GetNamedStmt(query string) (*sqlx.NamedStmt, error) {
+	if stmt := tx.stmts.namedStmts[query]; stmt != nil {
+		return stmt, nil
+	}
+
+	var txStmt *sqlx.NamedStmt
+	if entry := tx.n.namedStmtSet.acquireCached(query); entry != nil {
+		txStmt = tx.NamedStmtContext(tx.ctx, entry.stmt.(*sqlx.NamedStmt))
+		tx.stmts.releases = append(tx.stmts.releases, func() { tx.n.namedStmtSet.release(entry) })
+	} else {
+		var err error
+		if txStmt, err = tx.PrepareNamedContext(tx.ctx, query); err != nil {
+			return nil, err
+		}
+	}
+	tx.stmts.namedStmts[query] = txStmt
+	return txStmt, nil
+}
+
+func WithTx(ctx context.Context, opts *sql.TxOptions, fn func(tx *Tx) error) error {
+	return defaultHandle.WithTx(ctx, opts, fn)
+}
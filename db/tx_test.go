@@ -0,0 +1,219 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTxGetStmtUsesTxConn(t *testing.T) {
+	d, _ := newFakeDB(t)
+	d.SetMaxOpenConns(1)
+	h := newHandle("test")
+	h.SetDB(d)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := h.WithTx(ctx, nil, func(tx *Tx) error {
+		stmt, err := tx.GetStmt("UPDATE t SET a=?")
+		if err != nil {
+			return err
+		}
+		if _, err = stmt.Exec(1); err != nil {
+			return err
+		}
+		_, err = tx.GetNamedStmt("UPDATE t SET a=:a")
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := h.primaryNode().stmtSet.len(); n != 0 {
+		t.Errorf("stmt prepared in a tx is cached: %d", n)
+	}
+}
+
+func TestTxGetStmtBindsCached(t *testing.T) {
+	d, _ := newFakeDB(t)
+	h := newHandle("test")
+	h.SetCacheOptions(CacheOptions{})
+	h.SetDB(d)
+
+	ctx := context.Background()
+	if _, err := h.ExecContext(ctx, "UPDATE t SET a=?", 1); err != nil {
+		t.Fatal(err)
+	}
+	err := h.WithTx(ctx, nil, func(tx *Tx) error {
+		stmt, err := tx.GetStmt("UPDATE t SET a=?")
+		if err != nil {
+			return err
+		}
+		entry := h.primaryNode().stmtSet.acquireCached("UPDATE t SET a=?")
+		defer h.primaryNode().stmtSet.release(entry)
+		if entry.refs != 2 {
+			t.Errorf("cached stmt is not held by the tx, refs = %d", entry.refs)
+		}
+		_, err = stmt.Exec(2)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entry := h.primaryNode().stmtSet.acquireCached("UPDATE t SET a=?")
+	if entry.refs != 1 {
+		t.Errorf("tx did not release the cached stmt, refs = %d", entry.refs-1)
+	}
+}
+
+// txOps 返回事务的开始和结束以及执行过的语句, 忽略 prepare 和 close.
+func txOps(d *fakeDriver) []string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	var ops []string
+	for _, op := range d.ops {
+		switch {
+		case op == "begin", op == "commit", op == "rollback":
+			ops = append(ops, op)
+		case strings.HasPrefix(op, "exec "):
+			ops = append(ops, strings.TrimPrefix(op, "exec "))
+		}
+	}
+	return ops
+}
+
+func TestTxNested(t *testing.T) {
+	d, fake := newFakeDB(t)
+	h := newHandle("test")
+	h.SetDB(d)
+
+	errInner := errors.New("inner failed")
+	ctx := context.Background()
+	err := h.WithTx(ctx, nil, func(tx *Tx) error {
+		if _, err := tx.Exec("UPDATE t SET a=1"); err != nil {
+			return err
+		}
+		err := tx.WithTx(func(tx *Tx) error {
+			if tx.depth != 1 {
+				t.Errorf("depth = %d, want 1", tx.depth)
+			}
+			// 第二层使用 sp_2, 成功时释放
+			if err := tx.WithTx(func(tx *Tx) error {
+				_, err := tx.Exec("UPDATE t SET a=2")
+				return err
+			}); err != nil {
+				return err
+			}
+			return errInner
+		})
+		if err != errInner {
+			t.Errorf("inner err = %v, want %v", err, errInner)
+		}
+
+		// 回滚到 savepoint 之后外层事务可以继续使用, 同一层再次使用 sp_1
+		return tx.WithTx(func(tx *Tx) error {
+			_, err := tx.Exec("UPDATE t SET a=3")
+			return err
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"begin",
+		"UPDATE t SET a=1",
+		"SAVEPOINT sp_1",
+		"SAVEPOINT sp_2",
+		"UPDATE t SET a=2",
+		"RELEASE SAVEPOINT sp_2",
+		"ROLLBACK TO SAVEPOINT sp_1",
+		"SAVEPOINT sp_1",
+		"UPDATE t SET a=3",
+		"RELEASE SAVEPOINT sp_1",
+		"commit",
+	}
+	if ops := txOps(fake); !reflect.DeepEqual(ops, want) {
+		t.Errorf("ops = %q, want %q", ops, want)
+	}
+}
+
+func TestTxNestedPanic(t *testing.T) {
+	d, fake := newFakeDB(t)
+	h := newHandle("test")
+	h.SetDB(d)
+
+	var recovered interface{}
+	err := h.WithTx(context.Background(), nil, func(tx *Tx) error {
+		func() {
+			defer func() {
+				recovered = recover()
+			}()
+			tx.WithTx(func(tx *Tx) error {
+				panic("boom")
+			})
+		}()
+
+		// 外层事务捕获了 panic 之后仍然可以提交
+		_, err := tx.Exec("UPDATE t SET a=1")
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recovered != "boom" {
+		t.Errorf("recovered = %v, want the panic of the inner fn", recovered)
+	}
+
+	want := []string{"begin", "SAVEPOINT sp_1", "ROLLBACK TO SAVEPOINT sp_1", "UPDATE t SET a=1", "commit"}
+	if ops := txOps(fake); !reflect.DeepEqual(ops, want) {
+		t.Errorf("ops = %q, want %q", ops, want)
+	}
+
+	// 没有被捕获的 panic 回滚 savepoint 和整个事务
+	fake.ops = nil
+	func() {
+		defer func() {
+			if p := recover(); p != "boom" {
+				t.Errorf("recovered = %v", p)
+			}
+		}()
+		h.WithTx(context.Background(), nil, func(tx *Tx) error {
+			return tx.WithTx(func(tx *Tx) error {
+				panic("boom")
+			})
+		})
+	}()
+	want = []string{"begin", "SAVEPOINT sp_1", "ROLLBACK TO SAVEPOINT sp_1", "rollback"}
+	if ops := txOps(fake); !reflect.DeepEqual(ops, want) {
+		t.Errorf("ops = %q, want %q", ops, want)
+	}
+}
+
+func TestTxNestedSavepointError(t *testing.T) {
+	d, fake := newFakeDB(t)
+	h := newHandle("test")
+	h.SetDB(d)
+
+	errSavepoint := errors.New("savepoint failed")
+	fake.setFail(func(op, query string) error {
+		if op == "exec" && strings.HasPrefix(query, "SAVEPOINT") {
+			return errSavepoint
+		}
+		return nil
+	})
+	called := false
+	err := h.WithTx(context.Background(), nil, func(tx *Tx) error {
+		return tx.WithTx(func(tx *Tx) error {
+			called = true
+			return nil
+		})
+	})
+	if err != errSavepoint || called {
+		t.Errorf("err = %v, called = %v", err, called)
+	}
+}